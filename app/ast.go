@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pos is a position in the parsed input. Line and Col both start at 1.
+type Pos struct {
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("line %d, col %d", p.Line, p.Col)
+}
+
+// SyntaxNode is an element of the syntax tree returned by Parse.
+type SyntaxNode interface {
+	Position() Pos
+	String() string
+}
+
+// Redirection redirects the descriptor fd. op is the operator without the
+// descriptor number: `<`, `>`, `>>`, `>|`, `<>`, `<&`, `>&`, `&>`, `&>>`,
+// `<<`, `<<-` or `<<<`.
+type Redirection struct {
+	fd         int
+	op         string
+	fileName   string
+	appendOnly bool
+	target     *Token
+	// hereDoc is the body of a `<<` here-document. Once expanded, here-docs
+	// and `<<<` here-strings have their text in input instead of a fileName.
+	hereDoc []wordPart
+	isInput bool
+	input   string
+}
+
+func NewRedirection(fileName string) *Redirection {
+	return &Redirection{fileName: fileName}
+}
+
+// Command is a simple command: assignments, words and redirections.
+type Command struct {
+	pos          Pos
+	name         string
+	args         []string
+	env          []string
+	words        []*Token
+	assignments  []*Token
+	redirections []*Redirection
+}
+
+func New(name string, args []string, redirections []*Redirection) *Command {
+	return &Command{
+		name:         name,
+		args:         args,
+		redirections: redirections,
+	}
+}
+
+// NewSimpleCommand builds an unexpanded command; name and args are filled in
+// by Expand right before the command runs.
+func NewSimpleCommand(pos Pos, assignments []*Token, words []*Token, redirections []*Redirection) *Command {
+	return &Command{
+		pos:          pos,
+		words:        words,
+		assignments:  assignments,
+		redirections: redirections,
+	}
+}
+
+// Pipeline is a sequence of commands connected by `|`. A pipeline starting
+// with `!` negates the exit status of its last command.
+type Pipeline struct {
+	pos      Pos
+	commands []SyntaxNode
+	negated  bool
+}
+
+// AndOr is `left && right` or `left || right`.
+type AndOr struct {
+	pos      Pos
+	operator TokenType
+	left     SyntaxNode
+	right    SyntaxNode
+}
+
+// List is a sequence of commands separated by `;` or newlines.
+type List struct {
+	pos   Pos
+	items []SyntaxNode
+}
+
+// Background is `command &`: an and-or list run asynchronously as a job,
+// while the shell goes on with the next command.
+type Background struct {
+	pos  Pos
+	body SyntaxNode
+}
+
+// Subshell is `( list )`. Its body runs with a copy of the shell state, so
+// variable assignments and `cd` do not leak out of it.
+type Subshell struct {
+	pos          Pos
+	body         SyntaxNode
+	redirections []*Redirection
+}
+
+// BraceGroup is `{ list; }`, run in the current shell.
+type BraceGroup struct {
+	pos          Pos
+	body         SyntaxNode
+	redirections []*Redirection
+}
+
+// IfClause is `if condition; then body; else elseBody; fi`. An elif chain
+// is an IfClause in elseBody.
+type IfClause struct {
+	pos          Pos
+	condition    SyntaxNode
+	body         SyntaxNode
+	elseBody     SyntaxNode
+	redirections []*Redirection
+}
+
+// LoopClause is `while condition; do body; done`, or `until` when until is
+// set.
+type LoopClause struct {
+	pos          Pos
+	until        bool
+	condition    SyntaxNode
+	body         SyntaxNode
+	redirections []*Redirection
+}
+
+// ForClause is `for name in words; do body; done`. Without `in` it loops
+// over the positional parameters.
+type ForClause struct {
+	pos          Pos
+	name         string
+	words        []*Token
+	hasIn        bool
+	body         SyntaxNode
+	redirections []*Redirection
+}
+
+// CaseClause is `case word in pattern) body;; esac`.
+type CaseClause struct {
+	pos          Pos
+	word         *Token
+	items        []*CaseItem
+	redirections []*Redirection
+}
+
+type CaseItem struct {
+	patterns []*Token
+	body     SyntaxNode
+}
+
+// FunctionDefinition is `name() body`, where the body is a compound command.
+type FunctionDefinition struct {
+	pos  Pos
+	name string
+	body SyntaxNode
+}
+
+func (c *Command) Position() Pos    { return c.pos }
+func (p *Pipeline) Position() Pos   { return p.pos }
+func (a *AndOr) Position() Pos      { return a.pos }
+func (l *List) Position() Pos       { return l.pos }
+func (b *Background) Position() Pos { return b.pos }
+func (s *Subshell) Position() Pos   { return s.pos }
+func (b *BraceGroup) Position() Pos { return b.pos }
+func (i *IfClause) Position() Pos   { return i.pos }
+func (l *LoopClause) Position() Pos { return l.pos }
+func (f *ForClause) Position() Pos  { return f.pos }
+func (c *CaseClause) Position() Pos { return c.pos }
+
+func (f *FunctionDefinition) Position() Pos { return f.pos }
+
+// The String methods print a node back as shell source, normalizing the
+// spacing between tokens.
+
+func (c *Command) String() string {
+	var words []string
+	for _, assignment := range c.assignments {
+		words = append(words, assignment.raw)
+	}
+	for _, word := range c.words {
+		words = append(words, word.raw)
+	}
+	if redirections := formatRedirections(c.redirections); redirections != "" {
+		words = append(words, redirections)
+	}
+	return strings.Join(words, " ")
+}
+
+func (p *Pipeline) String() string {
+	commands := make([]string, len(p.commands))
+	for i, command := range p.commands {
+		commands[i] = command.String()
+	}
+	if p.negated {
+		return "! " + strings.Join(commands, " | ")
+	}
+	return strings.Join(commands, " | ")
+}
+
+func (a *AndOr) String() string {
+	operator := "&&"
+	if a.operator == orIfToken {
+		operator = "||"
+	}
+	return fmt.Sprintf("%s %s %s", a.left, operator, a.right)
+}
+
+func (l *List) String() string {
+	var s strings.Builder
+	for i, item := range l.items {
+		if i > 0 {
+			s.WriteString(" ")
+		}
+		if i < len(l.items)-1 {
+			s.WriteString(terminated(item))
+		} else {
+			s.WriteString(item.String())
+		}
+	}
+	return s.String()
+}
+
+func (b *Background) String() string {
+	return b.body.String() + " &"
+}
+
+// terminated returns the source of a list followed by the `;` ending it,
+// which a list ending with `&` does not need.
+func terminated(node SyntaxNode) string {
+	last := node
+	if list, ok := node.(*List); ok {
+		last = list.items[len(list.items)-1]
+	}
+	if _, ok := last.(*Background); ok {
+		return node.String()
+	}
+	return node.String() + ";"
+}
+
+func (s *Subshell) String() string {
+	return withRedirections(fmt.Sprintf("(%s)", s.body), s.redirections)
+}
+
+func (b *BraceGroup) String() string {
+	return withRedirections(fmt.Sprintf("{ %s }", terminated(b.body)), b.redirections)
+}
+
+func (i *IfClause) String() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "if %s then %s ", terminated(i.condition), terminated(i.body))
+	for clause := i; clause.elseBody != nil; {
+		elif, ok := clause.elseBody.(*IfClause)
+		if !ok {
+			fmt.Fprintf(&s, "else %s ", terminated(clause.elseBody))
+			break
+		}
+		fmt.Fprintf(&s, "elif %s then %s ", terminated(elif.condition), terminated(elif.body))
+		clause = elif
+	}
+	s.WriteString("fi")
+	return withRedirections(s.String(), i.redirections)
+}
+
+func (l *LoopClause) String() string {
+	keyword := "while"
+	if l.until {
+		keyword = "until"
+	}
+	return withRedirections(fmt.Sprintf("%s %s do %s done", keyword, terminated(l.condition), terminated(l.body)), l.redirections)
+}
+
+func (f *ForClause) String() string {
+	var s strings.Builder
+	s.WriteString("for " + f.name)
+	if f.hasIn {
+		s.WriteString(" in")
+		for _, word := range f.words {
+			s.WriteString(" " + word.raw)
+		}
+	}
+	fmt.Fprintf(&s, "; do %s done", terminated(f.body))
+	return withRedirections(s.String(), f.redirections)
+}
+
+func (c *CaseClause) String() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "case %s in", c.word.raw)
+	for _, item := range c.items {
+		patterns := make([]string, len(item.patterns))
+		for i, pattern := range item.patterns {
+			patterns[i] = pattern.raw
+		}
+		fmt.Fprintf(&s, " %s)", strings.Join(patterns, "|"))
+		if item.body != nil {
+			fmt.Fprintf(&s, " %s", item.body)
+		}
+		s.WriteString(";;")
+	}
+	s.WriteString(" esac")
+	return withRedirections(s.String(), c.redirections)
+}
+
+func (f *FunctionDefinition) String() string {
+	return fmt.Sprintf("%s() %s", f.name, f.body)
+}
+
+func withRedirections(s string, redirections []*Redirection) string {
+	if formatted := formatRedirections(redirections); formatted != "" {
+		return s + " " + formatted
+	}
+	return s
+}
+
+func formatRedirections(redirections []*Redirection) string {
+	var formatted []string
+	for _, r := range redirections {
+		op := r.op
+		if r.fd != defaultDescriptor(op) {
+			op = strconv.Itoa(r.fd) + op
+		}
+		target := r.target.raw
+		if r.op == "<<" || r.op == "<<-" {
+			op, target = hereDocString(r.hereDoc)
+			if r.fd != defaultDescriptor(op) {
+				op = strconv.Itoa(r.fd) + op
+			}
+		}
+		formatted = append(formatted, op+target)
+	}
+	return strings.Join(formatted, " ")
+}
+
+// hereDocString returns a here-document as the operator and word of the
+// `<<<` here-string that gives the same input, as its body cannot follow on
+// the lines after a node printed on one line.
+func hereDocString(body []wordPart) (string, string) {
+	if len(body) == 0 || len(body) == 1 && body[0].value == "" {
+		return "<", "/dev/null"
+	}
+	// a here-string gets the newline that ends the body back
+	last := &body[len(body)-1]
+	if last.kind == literalPart {
+		trimmed := *last
+		trimmed.value = strings.TrimSuffix(trimmed.value, "\n")
+		body = append(body[:len(body)-1:len(body)-1], trimmed)
+	}
+
+	var s strings.Builder
+	s.WriteString(`"`)
+	for _, part := range body {
+		switch part.kind {
+		case paramPart:
+			if strings.HasPrefix(part.value, "{") {
+				s.WriteString("$" + part.value)
+			} else {
+				s.WriteString("${" + part.value + "}")
+			}
+		case commandPart:
+			s.WriteString("$(" + part.value + ")")
+		default:
+			s.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(part.value))
+		}
+	}
+	s.WriteString(`"`)
+	return "<<<", s.String()
+}
+
+// defaultDescriptor is the descriptor an operator redirects when it is not
+// preceded by a number.
+func defaultDescriptor(op string) int {
+	if strings.HasPrefix(op, "<") {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// braceUnit is one rune of a literal word part, or a whole parameter or
+// command part, which brace expansion never looks into.
+type braceUnit struct {
+	r      rune
+	quoted bool
+	part   *wordPart
+}
+
+func (u braceUnit) is(r rune) bool {
+	return u.part == nil && !u.quoted && u.r == r
+}
+
+var (
+	numericSequence   = regexp.MustCompile(`^(-?\d+)\.\.(-?\d+)(?:\.\.(-?\d+))?$`)
+	characterSequence = regexp.MustCompile(`^([a-zA-Z])\.\.([a-zA-Z])(?:\.\.(-?\d+))?$`)
+)
+
+// expandBraces performs brace expansion on a word, turning `a{b,c}d` into
+// `abd acd` and `{1..3}` into `1 2 3`. It runs before every other expansion,
+// so it works on the word parts.
+func expandBraces(parts []wordPart) [][]wordPart {
+	var units []braceUnit
+	for i := range parts {
+		if parts[i].kind != literalPart {
+			units = append(units, braceUnit{part: &parts[i]})
+			continue
+		}
+		if parts[i].value == "" {
+			units = append(units, braceUnit{r: -1, quoted: parts[i].quoted})
+		}
+		for _, r := range parts[i].value {
+			units = append(units, braceUnit{r: r, quoted: parts[i].quoted})
+		}
+	}
+
+	var words [][]wordPart
+	for _, expanded := range braceAlternatives(units) {
+		words = append(words, joinUnits(expanded))
+	}
+	return words
+}
+
+// braceAlternatives expands the first brace expression in units and then,
+// recursively, the ones in each of its alternatives and after it.
+func braceAlternatives(units []braceUnit) [][]braceUnit {
+	for open := range units {
+		if !units[open].is('{') {
+			continue
+		}
+		closing, commas := matchBrace(units, open)
+		if closing < 0 {
+			continue
+		}
+
+		var alternatives [][]braceUnit
+		if len(commas) > 0 {
+			start := open + 1
+			for _, comma := range append(commas, closing) {
+				alternatives = append(alternatives, braceAlternatives(units[start:comma])...)
+				start = comma + 1
+			}
+		} else if sequence, ok := braceSequence(units[open+1 : closing]); ok {
+			for _, item := range sequence {
+				alternatives = append(alternatives, textUnits(item))
+			}
+		} else {
+			continue
+		}
+
+		// the alternatives vary slowest, so that a{b,c}d{1,2} is abd1 abd2
+		// acd1 acd2
+		suffixes := braceAlternatives(units[closing+1:])
+		var words [][]braceUnit
+		for _, alternative := range alternatives {
+			for _, suffix := range suffixes {
+				word := append([]braceUnit{}, units[:open]...)
+				word = append(word, alternative...)
+				words = append(words, append(word, suffix...))
+			}
+		}
+		return words
+	}
+	return [][]braceUnit{units}
+}
+
+// matchBrace finds the `}` closing the `{` at open and the top-level commas
+// in between. closing is -1 when the brace is not closed.
+func matchBrace(units []braceUnit, open int) (closing int, commas []int) {
+	depth := 0
+	for i := open; i < len(units); i++ {
+		switch {
+		case units[i].is('{'):
+			depth++
+		case units[i].is('}'):
+			depth--
+			if depth == 0 {
+				return i, commas
+			}
+		case units[i].is(',') && depth == 1:
+			commas = append(commas, i)
+		}
+	}
+	return -1, nil
+}
+
+// braceSequence expands `{x..y[..step]}` with x and y both integers or both
+// letters. Integers written with leading zeros are padded to the same width.
+func braceSequence(units []braceUnit) ([]string, bool) {
+	var text strings.Builder
+	for _, unit := range units {
+		if unit.part != nil || unit.quoted {
+			return nil, false
+		}
+		text.WriteRune(unit.r)
+	}
+
+	if match := numericSequence.FindStringSubmatch(text.String()); match != nil {
+		start, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, false
+		}
+		end, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, false
+		}
+		numbers, ok := sequence(start, end, match[3])
+		if !ok {
+			return nil, false
+		}
+		width := 0
+		for _, bound := range match[1:3] {
+			digits := strings.TrimPrefix(bound, "-")
+			if len(digits) > 1 && digits[0] == '0' {
+				width = max(width, len(bound))
+			}
+		}
+
+		var items []string
+		for _, n := range numbers {
+			items = append(items, fmt.Sprintf("%0*d", width, n))
+		}
+		return items, true
+	}
+
+	if match := characterSequence.FindStringSubmatch(text.String()); match != nil {
+		characters, ok := sequence(int(match[1][0]), int(match[2][0]), match[3])
+		if !ok {
+			return nil, false
+		}
+		var items []string
+		for _, r := range characters {
+			items = append(items, string(rune(r)))
+		}
+		return items, true
+	}
+	return nil, false
+}
+
+// sequence counts from start to end, up or down, by the absolute value of
+// step. It reports false when step is not a number it can count by.
+func sequence(start int, end int, step string) ([]int, bool) {
+	increment := 1
+	if step != "" {
+		n, err := strconv.Atoi(step)
+		if err != nil || n == math.MinInt {
+			return nil, false
+		}
+		if n != 0 {
+			increment = max(n, -n)
+		}
+	}
+
+	// the distance left is counted without sign, as it may not fit in an
+	// int, and the loop stops before going past end, which may overflow
+	var numbers []int
+	for n := start; ; {
+		numbers = append(numbers, n)
+		if start <= end {
+			if uint(end)-uint(n) < uint(increment) {
+				break
+			}
+			n += increment
+		} else {
+			if uint(n)-uint(end) < uint(increment) {
+				break
+			}
+			n -= increment
+		}
+	}
+	return numbers, true
+}
+
+func textUnits(s string) []braceUnit {
+	var units []braceUnit
+	for _, r := range s {
+		units = append(units, braceUnit{r: r})
+	}
+	return units
+}
+
+// joinUnits turns units back into word parts.
+func joinUnits(units []braceUnit) []wordPart {
+	var parts []wordPart
+	for _, unit := range units {
+		switch {
+		case unit.part != nil:
+			parts = append(parts, *unit.part)
+		case unit.r == -1:
+			parts = append(parts, wordPart{kind: literalPart, quoted: unit.quoted})
+		default:
+			parts = appendLiteral(parts, unit.r, unit.quoted)
+		}
+	}
+	return parts
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -17,6 +21,13 @@ type Executable interface {
 	GetStdout() io.Writer
 	GetStderr() io.Writer
 	GetCommandType() string
+	// SetExtraFiles gives the command the descriptors 3 to 9 opened by
+	// redirections.
+	SetExtraFiles(files map[int]*os.File)
+	// AddCloser hands over a pipe end to close once the command no longer
+	// needs it: right after starting for external commands, and when done
+	// for commands running inside the shell.
+	AddCloser(c io.Closer)
 	Start() error
 	Wait() error
 }
@@ -52,34 +63,42 @@ func (r *ResourceManager) AddWriter(writer io.Writer) {
 	r.writers = append(r.writers, writer)
 }
 
-func (r *ResourceManager) AddResource(executable Executable) {
-	r.AddReader(executable.GetStdin())
-	r.AddWriter(executable.GetStdout())
-	r.AddWriter(executable.GetStderr())
-}
+// errNotFound is returned by CreateExecutable for names that are neither
+// functions, builtins nor commands found in PATH.
+var errNotFound = errors.New("not found")
 
-func CreateExecutable(command *Command, r *ResourceManager) (Executable, error) {
+func CreateExecutable(command *Command, r *ResourceManager, streams *Streams) (Executable, error) {
 
-	if ShellBuiltinCommands[command.name] {
+	var executable Executable
+	if function, ok := functions[command.name]; ok {
+		functionCommand := NewFunctionCommand(function, command.args)
+		functionCommand.env = command.env
+		executable = functionCommand
+	} else if ShellBuiltinCommands[command.name] {
 		builtinCommand := NewBuiltinCommand(command.name, command.args...)
-		SetIO(&command.redirections, builtinCommand)
-		return builtinCommand, nil
-	}
-
-	if ok, path := isExternal(command.name); ok {
+		builtinCommand.env = command.env
+		executable = builtinCommand
+	} else if ok, path := isExternal(command.name); ok {
 		externalCommand := NewExternalCommand(path, command.args...)
 		externalCommand.cmd.Args = append([]string{command.name}, command.args...)
-		SetIO(&command.redirections, externalCommand)
-		r.AddResource(externalCommand)
-		return externalCommand, nil
+		if len(command.env) > 0 {
+			externalCommand.cmd.Env = append(os.Environ(), command.env...)
+		}
+		executable = externalCommand
+	} else {
+		return nil, fmt.Errorf("%s: %w", command.name, errNotFound)
 	}
 
-	return nil, fmt.Errorf("%s: not found", command.name)
+	if err := SetIO(command.redirections, executable, streams, r); err != nil {
+		return nil, err
+	}
+	return executable, nil
 }
 
 // ExternalCommand
 type ExternalCommand struct {
-	cmd *exec.Cmd
+	cmd     *exec.Cmd
+	closers []io.Closer
 }
 
 func NewExternalCommand(name string, args ...string) *ExternalCommand {
@@ -88,15 +107,35 @@ func NewExternalCommand(name string, args ...string) *ExternalCommand {
 	}
 }
 
+// the closed standard descriptors of an external command are opened on
+// /dev/null, since os/exec always gives it the first three
 func (e *ExternalCommand) SetStdin(in io.Reader) {
+	if _, closed := in.(closedStream); closed {
+		in = nil
+	}
 	e.cmd.Stdin = in
 }
 func (e *ExternalCommand) SetStdout(out io.Writer) {
+	if _, closed := out.(closedStream); closed {
+		out = nil
+	}
 	e.cmd.Stdout = out
 }
 func (e *ExternalCommand) SetStderr(err io.Writer) {
+	if _, closed := err.(closedStream); closed {
+		err = nil
+	}
 	e.cmd.Stderr = err
 }
+
+// SetExtraFiles passes files on as the descriptors they are open as; the
+// ones in between are closed in the child.
+func (e *ExternalCommand) SetExtraFiles(files map[int]*os.File) {
+	e.cmd.ExtraFiles = nil
+	for fd := 3; fd <= slices.Max(append(slices.Collect(maps.Keys(files)), 2)); fd++ {
+		e.cmd.ExtraFiles = append(e.cmd.ExtraFiles, files[fd])
+	}
+}
 func (e *ExternalCommand) GetStdin() io.Reader {
 	return e.cmd.Stdin
 }
@@ -111,22 +150,31 @@ func (e *ExternalCommand) GetCommandType() string {
 	return "EXTERNAL"
 }
 
+func (e *ExternalCommand) AddCloser(c io.Closer) {
+	e.closers = append(e.closers, c)
+}
+
 func (e *ExternalCommand) Start() error {
+	// the child has its own copies of the pipe ends once started
+	defer closeAll(e.closers)
 	return e.cmd.Start()
 }
 func (e *ExternalCommand) Wait() error {
-	return e.cmd.Wait()
+	return waitProcess(e.cmd)
 }
 
 // BuiltinCommand
 
 type BuiltinCommand struct {
-	Name   string
-	Args   []string
-	Stdin  io.Reader
-	Stdout io.Writer
-	Stderr io.Writer
-	Done   chan error
+	Name    string
+	Args    []string
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
+	Done    chan error
+	closers []io.Closer
+	// env are the assignments before the name, set while it runs
+	env []string
 }
 
 func NewBuiltinCommand(name string, args ...string) *BuiltinCommand {
@@ -147,6 +195,10 @@ func (b *BuiltinCommand) SetStderr(err io.Writer) {
 	b.Stderr = err
 }
 
+// builtins only use the standard descriptors
+func (b *BuiltinCommand) SetExtraFiles(files map[int]*os.File) {
+}
+
 func (b *BuiltinCommand) GetStdin() io.Reader {
 	return b.Stdin
 }
@@ -161,28 +213,21 @@ func (b *BuiltinCommand) GetCommandType() string {
 	return "BUILTIN"
 }
 
+func (b *BuiltinCommand) AddCloser(c io.Closer) {
+	b.closers = append(b.closers, c)
+}
+
 func (b *BuiltinCommand) Start() error {
 	go func() {
 
-		defer func() {
-
-			// ignore if standard I/O
-			if file, ok := b.Stdin.(*os.File); ok && !isStandardIoFile(file.Name()) {
-				file.Close()
-			}
-
-			if file, ok := b.Stdout.(*os.File); ok && !isStandardIoFile(file.Name()) {
-				file.Close()
-			}
-
-			if file, ok := b.Stderr.(*os.File); ok && !isStandardIoFile(file.Name()) {
-				file.Close()
-			}
-
-		}()
+		// closing our pipe ends lets the rest of the pipeline see EOF
+		defer closeAll(b.closers)
 
+		restore := applyTemporaryAssignments(b.env)
 		executeFn := BuiltinRegistry[b.Name]
-		b.Done <- executeFn(b.Args, b.Stdin, b.Stdout, b.Stderr)
+		err := executeFn(b.Args, b.Stdin, b.Stdout, b.Stderr)
+		restore()
+		b.Done <- err
 	}()
 	return nil
 }
@@ -195,12 +240,28 @@ func (b *BuiltinCommand) Wait() error {
 type BuiltinFunc func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
 
 var BuiltinRegistry = map[string]BuiltinFunc{
-	"pwd":     pwdBuiltin,
-	"echo":    echoBuiltin,
-	"type":    typeBuiltin,
-	"exit":    exitBuiltin,
-	"cd":      cdBuiltin,
-	"history": historyBuiltin,
+	"pwd":      pwdBuiltin,
+	"echo":     echoBuiltin,
+	"type":     typeBuiltin,
+	"exit":     exitBuiltin,
+	"cd":       cdBuiltin,
+	"history":  historyBuiltin,
+	"break":    breakBuiltin,
+	"continue": continueBuiltin,
+	"local":    localBuiltin,
+	"return":   returnBuiltin,
+	"shift":    shiftBuiltin,
+	"shopt":    shoptBuiltin,
+	"set":      setBuiltin,
+	"trap":     trapBuiltin,
+	"jobs":     jobsBuiltin,
+	"fg":       fgBuiltin,
+	"bg":       bgBuiltin,
+	"disown":   disownBuiltin,
+	"wait":     waitBuiltin,
+	"fc":       fcBuiltin,
+	"complete": completeBuiltin,
+	"compgen":  compgenBuiltin,
 }
 
 // pwd pwdBuiltin
@@ -219,32 +280,258 @@ func pwdBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writ
 // echo builtin
 func echoBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
 	data := strings.Join(args, " ")
-	fmt.Fprintln(stdout, data)
+	if _, err := fmt.Fprintln(stdout, data); err != nil {
+		fmt.Fprintf(stderr, "echo: write error: %v\n", err)
+		return ExitStatus(1)
+	}
 	return nil
 }
 
 // type builtin
 func typeBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
 
+	var err error
 	for _, command := range args {
 		commandName := strings.TrimSpace(command)
-		if ShellBuiltinCommands[commandName] {
+		if function, ok := functions[commandName]; ok {
+			fmt.Fprintf(stdout, "%s is a function\n%s\n", commandName, function)
+		} else if ShellBuiltinCommands[commandName] {
 			fmt.Fprintf(stdout, "%s is a shell builtin\n", commandName)
 		} else if ok, path := isExternal(commandName); ok {
 			fmt.Fprintf(stdout, "%s is %s\n", commandName, path)
 		} else {
 			fmt.Fprintf(stderr, "%s: not found\n", commandName)
+			err = ExitStatus(1)
 		}
 	}
-	return nil
+	return err
 }
 
 // exit builtin
 func exitBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
-	if path, ok := os.LookupEnv("HISTFILE"); ok {
-		history.AppendHistory(path)
+	status := lastExitStatus
+	if len(args) > 0 {
+		code, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(stderr, "exit: %s: numeric argument required\n", args[0])
+			code = 2
+		}
+		status = code
+	}
+
+	if subshellLevel > 0 {
+		pendingFlow = flowExit
+		return ExitStatus(status & 0xff)
+	}
+
+	exitShell(status)
+	return nil
+}
+
+// exitShell runs the EXIT trap, saves the history of an interactive shell
+// and exits with status.
+func exitShell(status int) {
+	runExitTrap(status)
+	if path, ok := os.LookupEnv("HISTFILE"); ok && interactive {
+		GetHistory().AppendHistory(path)
+	}
+	os.Exit(status & 0xff)
+}
+
+// breakBuiltin leaves the innermost n loops.
+func breakBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return loopControl("break", flowBreak, args, stderr)
+}
+
+// continueBuiltin starts the next iteration of the nth enclosing loop.
+func continueBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return loopControl("continue", flowContinue, args, stderr)
+}
+
+func loopControl(name string, flow flowKind, args []string, stderr io.Writer) error {
+	levels := 1
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fmt.Fprintf(stderr, "%s: %s: loop count out of range\n", name, args[0])
+			return ExitStatus(1)
+		}
+		levels = n
+	}
+
+	if loopLevel == 0 {
+		fmt.Fprintf(stderr, "%s: only meaningful in a `for', `while', or `until' loop\n", name)
+		return nil
+	}
+
+	pendingFlow = flow
+	flowLevels = min(levels, loopLevel)
+	return nil
+}
+
+// localBuiltin declares variables that keep their value only until the
+// running function returns: `local NAME[=value]...`.
+func localBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if functionLevel == 0 {
+		fmt.Fprintln(stderr, "local: can only be used in a function")
+		return ExitStatus(1)
+	}
+
+	var err error
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isValidName(name) {
+			fmt.Fprintf(stderr, "local: `%s': not a valid identifier\n", arg)
+			err = ExitStatus(1)
+			continue
+		}
+		declareLocal(name)
+		if hasValue {
+			setVar(name, value)
+		}
+	}
+	return err
+}
+
+// returnBuiltin leaves the running function with status n, or with the status
+// of the last command.
+func returnBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	status := lastExitStatus
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(stderr, "return: %s: numeric argument required\n", args[0])
+			n = 2
+		}
+		status = n
+	}
+
+	if functionLevel == 0 {
+		fmt.Fprintln(stderr, "return: can only `return' from a function")
+		return ExitStatus(1)
+	}
+
+	pendingFlow = flowReturn
+	return ExitStatus(status & 0xff)
+}
+
+// shiftBuiltin drops the first n positional parameters.
+func shiftBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	n := 1
+	if len(args) > 0 {
+		count, err := strconv.Atoi(args[0])
+		if err != nil || count < 0 {
+			fmt.Fprintf(stderr, "shift: %s: numeric argument required\n", args[0])
+			return ExitStatus(1)
+		}
+		n = count
+	}
+
+	if n > len(positionalParams) {
+		return ExitStatus(1)
+	}
+	positionalParams = positionalParams[n:]
+	return nil
+}
+
+// shoptBuiltin sets (-s), unsets (-u) or prints shell options.
+func shoptBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	action := ""
+	if len(args) > 0 && (args[0] == "-s" || args[0] == "-u") {
+		action, args = args[0], args[1:]
+	}
+
+	names := args
+	if len(names) == 0 {
+		names = slices.Sorted(maps.Keys(globOptions))
+	}
+
+	var err error
+	for _, name := range names {
+		enabled, ok := globOptions[name]
+		if !ok {
+			fmt.Fprintf(stderr, "shopt: %s: invalid shell option name\n", name)
+			err = ExitStatus(1)
+			continue
+		}
+
+		switch action {
+		case "-s":
+			globOptions[name] = true
+		case "-u":
+			globOptions[name] = false
+		default:
+			state := "off"
+			if enabled {
+				state = "on"
+			} else if len(args) > 0 {
+				err = ExitStatus(1)
+			}
+			fmt.Fprintf(stdout, "%-15s\t%s\n", name, state)
+		}
+	}
+	return err
+}
+
+// setBuiltin turns options on with `-` and off with `+`, either by letter,
+// as in `set -C`, or by name, as in `set -o noclobber`. The arguments after
+// the options, or after `--`, replace the positional parameters. Without
+// arguments it prints the variables.
+func setBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if len(args) == 0 {
+		variables := os.Environ()
+		slices.Sort(variables)
+		for _, variable := range variables {
+			fmt.Fprintln(stdout, variable)
+		}
+		return nil
+	}
+
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			positionalParams = args[1:]
+			return nil
+		}
+		if len(arg) < 2 || (arg[0] != '-' && arg[0] != '+') {
+			break
+		}
+		args = args[1:]
+		enable := arg[0] == '-'
+
+		if arg[1:] == "o" {
+			if len(args) == 0 {
+				for _, name := range slices.Sorted(maps.Keys(shellOptions)) {
+					state := "off"
+					if shellOptions[name] {
+						state = "on"
+					}
+					fmt.Fprintf(stdout, "%-15s\t%s\n", name, state)
+				}
+				return nil
+			}
+			if _, ok := shellOptions[args[0]]; !ok {
+				fmt.Fprintf(stderr, "set: %s: invalid option name\n", args[0])
+				return ExitStatus(2)
+			}
+			shellOptions[args[0]] = enable
+			args = args[1:]
+			continue
+		}
+
+		for i := 1; i < len(arg); i++ {
+			name, ok := shellOptionLetters[arg[i]]
+			if !ok {
+				fmt.Fprintf(stderr, "set: %c%c: invalid option\n", arg[0], arg[i])
+				return ExitStatus(2)
+			}
+			shellOptions[name] = enable
+		}
+	}
+
+	if len(args) > 0 {
+		positionalParams = args
 	}
-	os.Exit(0)
 	return nil
 }
 
@@ -255,46 +542,242 @@ func cdBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Write
 	if len(args) > 0 {
 		directory = args[0]
 	} else {
-		directory = "$HOME"
-	}
-
-	if strings.HasPrefix(directory, "~") {
-		directory = strings.ReplaceAll(directory, "~", "$HOME")
+		directory = os.Getenv("HOME")
 	}
 
-	directory = os.ExpandEnv(directory)
-
 	info, err := os.Stat(directory)
 	if err != nil || !info.IsDir() {
 		fmt.Fprintf(stderr, "cd: %s: No such file or directory\n", directory)
 		return fmt.Errorf("cd: %s: No such file or directory", directory)
 	}
-	return os.Chdir(directory)
+
+	previous, _ := os.Getwd()
+	if err := os.Chdir(directory); err != nil {
+		return err
+	}
+	// PWD and OLDPWD back the `~+` and `~-` expansions
+	current, _ := os.Getwd()
+	setVar("OLDPWD", previous)
+	setVar("PWD", current)
+	return nil
 }
 
+// historyBuiltin lists the history, or its last n commands with
+// `history n`. `-v` adds the start time, duration, exit status and working
+// directory of the commands, `-F` only lists the ones that failed, and
+// `-D dir` the ones run in dir. `-c` clears the history and `-d offset` or
+// `-d start-end` deletes commands from it. `-r`, `-w`, `-a` and `-n` read
+// the history from a file, HISTFILE by default, write it, append the new
+// commands to it, or read the commands other shells appended. `-s` stores
+// its arguments as a command and `-p` prints their history expansion.
 func historyBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
 
-	switch len(args) {
-	case 0:
-		data := history.GetLast(len(history.commands))
-		fmt.Fprint(stdout, data)
-	case 1:
-		arg := args[0]
-		count, _ := strconv.Atoi(arg)
-		data := history.GetLast(count)
-		fmt.Fprint(stdout, data)
-	case 2:
-		option, file := args[0], args[1]
+	hist := GetHistory()
+	verbose, failed, dir := false, false, ""
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		option := args[0]
+		args = args[1:]
 		switch option {
-		case `-r`:
-			history.LoadHistory(file)
-		case `-w`:
-			history.WriteHistory(file)
-		case `-a`:
-			history.AppendHistory(file)
+		case "--":
+			return listHistory(hist, args, verbose, failed, dir, stdout, stderr)
+		case "-v":
+			verbose = true
+		case "-F":
+			failed = true
+		case "-D":
+			if len(args) == 0 {
+				fmt.Fprintln(stderr, "history: -D: option requires an argument")
+				return historyUsage(stderr)
+			}
+			dir, _ = filepath.Abs(args[0])
+			args = args[1:]
+		case "-c":
+			hist.Clear()
+			return nil
+		case "-d":
+			if len(args) == 0 {
+				fmt.Fprintln(stderr, "history: -d: option requires an argument")
+				return historyUsage(stderr)
+			}
+			return deleteHistory(hist, args[0], stderr)
+		case "-r", "-w", "-a", "-n":
+			if len(args) > 1 {
+				fmt.Fprintln(stderr, "history: too many arguments")
+				return ExitStatus(1)
+			}
+			file := os.Getenv("HISTFILE")
+			if len(args) > 0 {
+				file = args[0]
+			}
+			if file == "" {
+				fmt.Fprintln(stderr, "history: HISTFILE is not set")
+				return ExitStatus(1)
+			}
+			switch option {
+			case `-r`:
+				hist.LoadHistory(file)
+			case `-w`:
+				hist.WriteHistory(file)
+			case `-a`:
+				hist.AppendHistory(file)
+			case `-n`:
+				hist.ReadNew(file)
+			}
+			return nil
+		case "-s":
+			// the arguments take the place of the history command itself
+			forgetCommandLine(hist)
+			if len(args) > 0 {
+				hist.Add(strings.Join(args, " "))
+			}
+			return nil
+		case "-p":
+			forgetCommandLine(hist)
+			for _, arg := range args {
+				expanded, _, err := expandHistory(arg, hist)
+				if err != nil {
+					fmt.Fprintf(stderr, "history: %v\n", err)
+					return ExitStatus(1)
+				}
+				fmt.Fprintln(stdout, expanded)
+			}
+			return nil
+		default:
+			fmt.Fprintf(stderr, "history: %s: invalid option\n", option)
+			return historyUsage(stderr)
 		}
+	}
+	return listHistory(hist, args, verbose, failed, dir, stdout, stderr)
+}
 
+func historyUsage(stderr io.Writer) error {
+	fmt.Fprintln(stderr, "history: usage: history [-c] [-d offset] [-vF] [-D dir] [n] or history -anrw [filename] or history -ps arg [arg...]")
+	return ExitStatus(2)
+}
+
+// listHistory prints the last n commands of the history, n being the
+// argument if any, with their metadata when verbose. failed and dir only
+// keep the commands that failed or ran in dir.
+func listHistory(hist *History, args []string, verbose, failed bool, dir string, stdout io.Writer, stderr io.Writer) error {
+	entries := hist.Entries()
+	count := len(entries)
+	if len(args) > 1 {
+		fmt.Fprintln(stderr, "history: too many arguments")
+		return ExitStatus(1)
 	}
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			fmt.Fprintf(stderr, "history: %s: numeric argument required\n", args[0])
+			return ExitStatus(1)
+		}
+		count = n
+	}
+
+	var listed []int
+	for i := len(entries) - 1; i >= 0 && len(listed) < count; i-- {
+		entry := entries[i]
+		if failed && (entry.Status == 0 || entry.Duration == 0) || dir != "" && entry.Dir != dir {
+			continue
+		}
+		listed = append(listed, i)
+	}
+	for _, i := range slices.Backward(listed) {
+		fmt.Fprint(stdout, formatHistoryEntry(i+1, entries[i], verbose))
+	}
+	return nil
+}
+
+// deleteHistory deletes the command at offset in the history, or the ones
+// from start to end for start-end. Negative offsets count back from the end
+// of the history, -1 being the last command.
+func deleteHistory(hist *History, arg string, stderr io.Writer) error {
+	size := hist.GetHistoryIndex()
+	// position turns an offset into an index of the history
+	position := func(offset string) (int, bool) {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n == 0 {
+			return 0, false
+		}
+		if n < 0 {
+			n += size + 1
+		}
+		return n - 1, n >= 1 && n <= size
+	}
+
+	first, last := arg, arg
+	// a - after the first character separates the offsets of a range
+	if dash := strings.IndexByte(arg[min(1, len(arg)):], '-'); dash >= 0 {
+		first, last = arg[:dash+1], arg[dash+2:]
+	}
+	from, ok := position(first)
+	to, ok2 := position(last)
+	if !ok || !ok2 || from > to {
+		fmt.Fprintf(stderr, "history: %s: history position out of range\n", arg)
+		return ExitStatus(1)
+	}
+	hist.Delete(from, to)
+	return nil
+}
 
+// NodeCommand runs a compound command, such as a brace group or a subshell,
+// as one element of a pipeline.
+type NodeCommand struct {
+	node    SyntaxNode
+	streams Streams
+	closers []io.Closer
+	done    chan int
+}
+
+func NewNodeCommand(node SyntaxNode, streams *Streams) *NodeCommand {
+	return &NodeCommand{
+		node:    node,
+		streams: *streams,
+		done:    make(chan int),
+	}
+}
+
+func (n *NodeCommand) SetStdin(in io.Reader) {
+	n.streams.Stdin = in
+}
+func (n *NodeCommand) SetStdout(out io.Writer) {
+	n.streams.Stdout = out
+}
+func (n *NodeCommand) SetStderr(err io.Writer) {
+	n.streams.Stderr = err
+}
+func (n *NodeCommand) SetExtraFiles(files map[int]*os.File) {
+	n.streams.Extra = files
+}
+func (n *NodeCommand) GetStdin() io.Reader {
+	return n.streams.Stdin
+}
+func (n *NodeCommand) GetStdout() io.Writer {
+	return n.streams.Stdout
+}
+func (n *NodeCommand) GetStderr() io.Writer {
+	return n.streams.Stderr
+}
+
+func (n *NodeCommand) GetCommandType() string {
+	return "COMPOUND"
+}
+
+func (n *NodeCommand) AddCloser(c io.Closer) {
+	n.closers = append(n.closers, c)
+}
+
+func (n *NodeCommand) Start() error {
+	go func() {
+		status := execute(n.node, &n.streams)
+		closeAll(n.closers)
+		n.done <- status
+	}()
+	return nil
+}
+func (n *NodeCommand) Wait() error {
+	if status := <-n.done; status != 0 {
+		return ExitStatus(status)
+	}
 	return nil
 }
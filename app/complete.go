@@ -0,0 +1,264 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// completion is what Tab completes the word under the cursor with.
+type completion struct {
+	// start is where the word starts in the line, and text what replaces
+	// it up to the cursor
+	start int
+	text  string
+	// matches are the names listed when there are several
+	matches []string
+}
+
+// commandWords keep the next word in command position.
+var commandWords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "while": true, "until": true,
+	"do": true, "!": true, "{": true, "time": true,
+}
+
+// completeWord completes the word of line that ends at the cursor pos: as a
+// command, a builtin, function or executable of PATH, when it is the first
+// word of a command, with the spec the complete builtin registered for the
+// command if any, and as a path otherwise, or when it has a slash. Hidden
+// files only match words starting with a dot, and directories get a
+// trailing slash. The text replacing the word is quoted like the word is,
+// or with backslashes.
+func completeWord(line []rune, pos int, builtins *Trie) completion {
+	start, word, quoteRune, words, redirection := wordAt(line, pos)
+
+	var candidates []string
+	space, quoted := true, true
+	switch {
+	case redirection:
+		candidates = completePath(word, false)
+	case len(words) == 0 && !strings.Contains(word, "/"):
+		builtinNames := builtins.SearchAll(word)
+		executables := SearchAllExecutable(word)
+		var functionNames []string
+		for name := range functions {
+			if strings.HasPrefix(name, word) {
+				functionNames = append(functionNames, name)
+			}
+		}
+		AddItems(&candidates, &builtinNames)
+		AddItems(&candidates, &functionNames)
+		AddItems(&candidates, &executables)
+	case len(words) == 0:
+		candidates = completePath(word, true)
+	default:
+		spec := findCompletionSpec(words[0])
+		if spec == nil {
+			candidates = completePath(word, false)
+			break
+		}
+		context := &completionContext{line: string(line), point: pos, words: append(words, word)}
+		candidates = spec.complete(word, context)
+		space, quoted = !spec.options["nospace"], !spec.options["noquote"]
+	}
+	slices.Sort(candidates)
+	candidates = slices.Compact(candidates)
+
+	quote := func(s string) string {
+		if !quoted {
+			return s
+		}
+		return quoteCompletion(s, quoteRune)
+	}
+
+	result := completion{start: start}
+	switch len(candidates) {
+	case 0:
+		return result
+	case 1:
+		result.text = quote(candidates[0])
+		if !strings.HasSuffix(candidates[0], "/") && space {
+			if quoted && quoteRune != 0 {
+				result.text += string(quoteRune)
+			}
+			result.text += " "
+		}
+		result.matches = candidates
+		return result
+	}
+
+	prefix := candidates[0]
+	for _, candidate := range candidates[1:] {
+		prefix = CommponPrefix(prefix, candidate)
+	}
+	// the prefix may end in the middle of a character
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	result.text = quote(prefix)
+	if !strings.HasPrefix(prefix, word) {
+		// what the spec matched does not start with the word
+		result.text = string(line[start:pos])
+	}
+	// the names listed are the last parts of paths
+	dir := word[:strings.LastIndexByte(word, '/')+1]
+	for _, candidate := range candidates {
+		result.matches = append(result.matches, strings.TrimPrefix(candidate, dir))
+	}
+	return result
+}
+
+// wordAt finds the word of line that ends at pos. It returns where the
+// word starts, the word with its quotes removed, the quote left open in it
+// if any, the words of its command before it, from the command name on,
+// and whether it is the file of a redirection. The word is in command
+// position when no words come before it.
+func wordAt(line []rune, pos int) (int, string, rune, []string, bool) {
+	start := pos
+	var word strings.Builder
+	var words []string
+	var quote rune
+	inWord, escaped := false, false
+	redirection := false
+
+	// endWord handles the word that just ended: assignments and reserved
+	// words before the command name are not part of the command
+	endWord := func(end int) {
+		if !inWord {
+			return
+		}
+		raw := string(line[start:end])
+		switch {
+		case redirection:
+			redirection = false
+		case len(words) > 0 || !commandWords[raw] && !isAssignmentWord(raw):
+			words = append(words, word.String())
+		}
+		inWord = false
+		word.Reset()
+	}
+	startWord := func(i int) {
+		if !inWord {
+			inWord, start = true, i
+		}
+	}
+
+	for i := 0; i < pos; i++ {
+		r := line[i]
+		switch {
+		case escaped:
+			escaped = false
+			word.WriteRune(r)
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' && i+1 < pos && strings.ContainsRune(`"\$`+"`", line[i+1]) {
+				escaped = true
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			startWord(i)
+			escaped = true
+		case r == '\'' || r == '"':
+			startWord(i)
+			quote = r
+		case r == ' ' || r == '\t' || r == '\n':
+			endWord(i)
+		case r == '<' || r == '>' || r == '&' && i+1 < pos && line[i+1] == '>':
+			// a number right before is the descriptor redirected
+			if inWord && strings.Trim(string(line[start:i]), "0123456789") == "" {
+				inWord = false
+				word.Reset()
+			}
+			endWord(i)
+			redirection = true
+		case r == '&' && i > 0 && (line[i-1] == '>' || line[i-1] == '<'):
+			// >& duplicates a descriptor
+		case strings.ContainsRune("|;&()", r):
+			endWord(i)
+			words, redirection = nil, false
+		default:
+			startWord(i)
+			word.WriteRune(r)
+		}
+	}
+	if !inWord {
+		start = pos
+	}
+	return start, word.String(), quote, words, redirection
+}
+
+// isAssignmentWord reports whether word assigns a variable, like `a=1`.
+func isAssignmentWord(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	return ok && isValidName(name)
+}
+
+// completePath returns the paths that start with prefix, with a slash after
+// the directories. Only directories and executables are kept for commands.
+// A leading ~/ is the home directory.
+func completePath(prefix string, command bool) []string {
+	dir, base := prefix[:strings.LastIndexByte(prefix, '/')+1], prefix[strings.LastIndexByte(prefix, '/')+1:]
+	path := homePath(dir)
+	if path == "" {
+		path = "."
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		// links are completed as what they point to
+		info, err := os.Stat(filepath.Join(path, name))
+		switch {
+		case err != nil:
+			if command {
+				continue
+			}
+		case info.IsDir():
+			name += "/"
+		case command && info.Mode()&0111 == 0:
+			continue
+		}
+		paths = append(paths, dir+name)
+	}
+	return paths
+}
+
+// homePath returns path with a leading ~/ replaced by the home directory.
+func homePath(path string) string {
+	if home, ok := os.LookupEnv("HOME"); ok && strings.HasPrefix(path, "~/") {
+		return home + path[1:]
+	}
+	return path
+}
+
+// quoteCompletion quotes s to replace a word that has quote left open, or
+// with backslashes before the characters special to the shell.
+func quoteCompletion(s string, quote rune) string {
+	switch quote {
+	case '\'':
+		return "'" + strings.ReplaceAll(s, "'", `'\''`)
+	case '"':
+		return `"` + strings.NewReplacer(`"`, `\"`, `\`, `\\`, "$", `\$`, "`", "\\`").Replace(s)
+	}
+
+	var quoted strings.Builder
+	for i, r := range s {
+		// a leading ~ is the home directory only when the path starts with ~/
+		if strings.ContainsRune(" \t\n'\"\\$`&|;<>()*?[]!{}#", r) || r == '~' && i == 0 && !strings.HasPrefix(s, "~/") {
+			quoted.WriteByte('\\')
+		}
+		quoted.WriteRune(r)
+	}
+	return quoted.String()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCompleteWord(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, name := range []string{"src/main.go", "src/util.go", "scripts/run", "my file.txt", "notes.md", ".hidden", "bin/tool"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "bin/tool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("src", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	t.Setenv("HOME", filepath.Join(dir, "src"))
+	t.Setenv("PATH", filepath.Join(dir, "bin"))
+
+	builtins := NewTrie()
+	builtins.InsertAll("echo", "exit", "history")
+
+	tests := []struct {
+		line     string
+		text     string
+		matches  []string
+		expected string
+	}{
+		{"ca", "", nil, ""},
+		{"his", "history ", []string{"history"}, "history "},
+		{"e", "e", []string{"echo", "exit"}, "e"},
+		{"to", "tool ", []string{"tool"}, "tool "},
+		{"cat ./sr", "./src/", []string{"./src/"}, "cat ./src/"},
+		{"cat sr", "src/", []string{"src/"}, "cat src/"},
+		{"cat src/", "src/", []string{"main.go", "util.go"}, "cat src/"},
+		{"cat src/u", "src/util.go ", []string{"src/util.go"}, "cat src/util.go "},
+		{"cat s", "s", []string{"scripts/", "src/"}, "cat s"},
+		{"cat li", "link/", []string{"link/"}, "cat link/"},
+		{"cat ", "", []string{"bin/", "link/", "my file.txt", "notes.md", "scripts/", "src/"}, "cat "},
+		{"cat .h", ".hidden ", []string{".hidden"}, "cat .hidden "},
+		{"cat my", `my\ file.txt `, []string{"my file.txt"}, `cat my\ file.txt `},
+		{`cat my\ f`, `my\ file.txt `, []string{"my file.txt"}, `cat my\ file.txt `},
+		{`cat "my`, `"my file.txt" `, []string{"my file.txt"}, `cat "my file.txt" `},
+		{"cat 'my", "'my file.txt' ", []string{"my file.txt"}, "cat 'my file.txt' "},
+		{"cat ~/m", "~/main.go ", []string{"~/main.go"}, "cat ~/main.go "},
+		{"./bi", "./bin/", []string{"./bin/"}, "./bin/"},
+		{"./bin/t", "./bin/tool ", []string{"./bin/tool"}, "./bin/tool "},
+		{"src/m", "", nil, "src/m"},
+		{"echo hi > no", "notes.md ", []string{"notes.md"}, "echo hi > notes.md "},
+		{"echo hi 2>no", "notes.md ", []string{"notes.md"}, "echo hi 2>notes.md "},
+		{"ls | to", "tool ", []string{"tool"}, "ls | tool "},
+		{"a=1 to", "tool ", []string{"tool"}, "a=1 tool "},
+		{"if to", "tool ", []string{"tool"}, "if tool "},
+		{"< notes.md to", "tool ", []string{"tool"}, "< notes.md tool "},
+		{"cat notes.md; ec", "echo ", []string{"echo"}, "cat notes.md; echo "},
+		{"ls && ", "", []string{"echo", "exit", "history", "tool"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			line := []rune(tt.line)
+			completed := completeWord(line, len(line), builtins)
+			if completed.text != tt.text || !slices.Equal(completed.matches, tt.matches) {
+				t.Errorf("%q completed with %q and %q, expected: %q and %q", tt.line, completed.text, completed.matches, tt.text, tt.matches)
+			}
+			if completed.text == "" {
+				return
+			}
+			if got := string(line[:completed.start]) + completed.text; got != tt.expected {
+				t.Errorf("%q completed to %q, expected: %q", tt.line, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProgrammableCompletion(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"app.yaml", "notes.md"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+	defer clear(completionSpecs)
+	defer delete(functions, "_deploy")
+
+	CommandSubstitution(`_deploy() {
+		if [ "$COMP_CWORD" = 1 ]; then
+			COMPREPLY=$(compgen -W "deploy destroy status" -- "$2")
+		else
+			COMPREPLY=$(compgen -W "prod staging $COMP_CWORD:$3" -- "$2")
+		fi
+	}`)
+	CommandSubstitution(`complete -F _deploy deployctl
+		complete -W "start stop" -o nospace svc
+		complete -f -X '*.md' edit
+		complete -d -D`)
+
+	tests := []struct {
+		line    string
+		text    string
+		matches []string
+	}{
+		{"deployctl s", "status ", []string{"status"}},
+		{"deployctl d", "de", []string{"deploy", "destroy"}},
+		{"deployctl deploy p", "prod ", []string{"prod"}},
+		{"deployctl deploy 2", "2:deploy ", []string{"2:deploy"}},
+		{"/usr/bin/deployctl s", "status ", []string{"status"}},
+		{"svc sta", "start", []string{"start"}},
+		{"edit ", "", []string{"app.yaml", "conf/"}},
+		{"edit c", "conf/", []string{"conf/"}},
+		{"other ", "conf/", []string{"conf/"}},
+		{"deployctl s > no", "notes.md ", []string{"notes.md"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			line := []rune(tt.line)
+			completed := completeWord(line, len(line), NewTrie())
+			if completed.text != tt.text || !slices.Equal(completed.matches, tt.matches) {
+				t.Errorf("%q completed with %q and %q, expected: %q and %q", tt.line, completed.text, completed.matches, tt.text, tt.matches)
+			}
+		})
+	}
+
+	if _, ok := os.LookupEnv("COMP_WORDS"); ok {
+		t.Errorf("COMP_WORDS is still set after completing")
+	}
+}
+
+func TestCompleteBuiltins(t *testing.T) {
+
+	defer clear(completionSpecs)
+	t.Setenv("GOSH_TEST_VAR", "1")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"compgen -W 'deploy destroy status' de", "deploy\ndestroy"},
+		{"compgen -W 'a b' z; echo $?", "1"},
+		{"compgen -b -X '!e*'", "echo\nexit"},
+		{"compgen -A signal SIGT", "SIGTERM"},
+		{"compgen -k fu", "function"},
+		{"compgen -v GOSH_TEST", "GOSH_TEST_VAR"},
+		{"compgen -P pre- -S .x -W 'one two'", "pre-one.x\npre-two.x"},
+		{"compgen -W 'alpha beta' -X '&*' a", ""},
+		{"compgen -C 'echo got' x", "got  x "},
+		{"compgen -A bogus 2>&1; echo $?", "compgen: bogus: invalid action name\n1"},
+		{"compgen -q 2>/dev/null; echo $?", "2"},
+		{"compgen -W 2>&1 >/dev/null | head -1", "compgen: -W: option requires an argument"},
+		{"complete -W 'a b' -o nospace tool; complete -p tool", "complete -o nospace -W 'a b' tool"},
+		{"complete -F _f -d -D; complete -p", "complete -d -F _f -D"},
+		{"complete -f x y; complete -r x; complete -p", "complete -f y"},
+		{"complete -p nope 2>&1; echo $?", "complete: nope: no completion specification\n1"},
+		{"complete -W x 2>/dev/null; echo $?", "2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			clear(completionSpecs)
+			if got := CommandSubstitution(tt.input); got != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// completionSpec says how the arguments of a command are completed, as
+// registered with the complete builtin.
+type completionSpec struct {
+	// actions name the kinds of names matched, like file or variable
+	actions []string
+	// glob, words, function and command are the -G, -W, -F and -C options
+	glob, words, function, command string
+	// filter removes the matches of -X, or keeps them when it starts with !
+	filter         string
+	prefix, suffix string
+	// options are the -o options, such as nospace or filenames
+	options map[string]bool
+}
+
+// completionSpecs are the specs of the complete builtin by command name,
+// the one for commands without their own being under "".
+var completionSpecs = map[string]*completionSpec{}
+
+// completionActions map the letters of the complete builtin that stand for
+// an action to its name.
+var completionActions = map[byte]string{
+	'b': "builtin", 'c': "command", 'd': "directory", 'e': "export", 'f': "file",
+	'j': "job", 'k': "keyword", 'u': "user", 'v': "variable",
+}
+
+// completionActionNames are the actions -A takes.
+var completionActionNames = []string{
+	"builtin", "command", "directory", "export", "file", "function", "hostname",
+	"job", "keyword", "signal", "user", "variable",
+}
+
+// completionOptions are the options -o takes.
+var completionOptions = []string{"bashdefault", "default", "dirnames", "filenames", "noquote", "nospace", "plusdirs"}
+
+// completionContext is the command line being completed, which functions
+// and commands of specs get as COMP_LINE, COMP_POINT, COMP_WORDS and
+// COMP_CWORD.
+type completionContext struct {
+	line  string
+	point int
+	// words are the words of the command up to the one completed
+	words []string
+}
+
+// findCompletionSpec returns the spec for the command name, or for its
+// base name, or the default one.
+func findCompletionSpec(name string) *completionSpec {
+	for _, key := range []string{name, filepath.Base(name), ""} {
+		if spec, ok := completionSpecs[key]; ok {
+			return spec
+		}
+	}
+	return nil
+}
+
+// complete returns the completions of word, the last of the words of
+// context, with a slash after directories when they are file names.
+func (s *completionSpec) complete(word string, context *completionContext) []string {
+	matches := s.generate(word, context)
+	if s.options["plusdirs"] || s.options["dirnames"] && len(matches) == 0 {
+		matches = append(matches, completeDirectories(word)...)
+	}
+	if len(matches) == 0 && (s.options["default"] || s.options["bashdefault"]) {
+		return completePath(word, false)
+	}
+
+	if s.options["filenames"] || s.options["dirnames"] || s.options["plusdirs"] ||
+		slices.Contains(s.actions, "file") || slices.Contains(s.actions, "directory") {
+		for i, match := range matches {
+			if !strings.HasSuffix(match, "/") && isDirectory(homePath(match)) {
+				matches[i] += "/"
+			}
+		}
+	}
+	return matches
+}
+
+// generate returns the matches of the spec for word: the names of its
+// actions, the paths of its glob and the words of its word list that start
+// with word, what its function puts in COMPREPLY and what its command
+// prints, one per line. The filter and the prefix and suffix are applied
+// to them all.
+func (s *completionSpec) generate(word string, context *completionContext) []string {
+	var matches []string
+	for _, action := range s.actions {
+		matches = append(matches, completeAction(action, word)...)
+	}
+	if s.glob != "" {
+		matches = append(matches, glob(s.glob)...)
+	}
+	if s.words != "" {
+		if words, err := expandText(s.words); err == nil {
+			for _, candidate := range strings.FieldsFunc(words, func(r rune) bool {
+				return strings.ContainsRune(fieldSeparators(), r)
+			}) {
+				if strings.HasPrefix(candidate, word) {
+					matches = append(matches, candidate)
+				}
+			}
+		}
+	}
+	if s.function != "" || s.command != "" {
+		matches = append(matches, s.run(word, context)...)
+	}
+
+	if s.filter != "" {
+		filter, keep := s.filter, false
+		if strings.HasPrefix(filter, "!") {
+			filter, keep = filter[1:], true
+		}
+		// & in the filter is the word completed
+		filter = strings.ReplaceAll(filter, "&", escapePattern(word))
+		matches = slices.DeleteFunc(matches, func(match string) bool {
+			return MatchPattern(filter, match) != keep
+		})
+	}
+	for i, match := range matches {
+		matches[i] = s.prefix + match + s.suffix
+	}
+	return matches
+}
+
+// run calls the function of the spec, and runs its command, with the name
+// of the command completed, the word and the word before it as arguments.
+// COMP_LINE, COMP_POINT, COMP_WORDS, a word per line, and COMP_CWORD, the
+// index of the word in COMP_WORDS, describe the command line. The function
+// puts the completions in COMPREPLY, one per line, and the command prints
+// them.
+func (s *completionSpec) run(word string, context *completionContext) []string {
+	status := lastExitStatus
+	defer func() { lastExitStatus = status }()
+
+	args := []string{"", word, ""}
+	if context != nil {
+		args[0] = context.words[0]
+		if n := len(context.words); n > 1 {
+			args[2] = context.words[n-2]
+		}
+		setVar("COMP_LINE", context.line)
+		setVar("COMP_POINT", strconv.Itoa(context.point))
+		setVar("COMP_WORDS", strings.Join(context.words, "\n"))
+		setVar("COMP_CWORD", strconv.Itoa(len(context.words)-1))
+		defer func() {
+			for _, name := range []string{"COMP_LINE", "COMP_POINT", "COMP_WORDS", "COMP_CWORD"} {
+				os.Unsetenv(name)
+			}
+		}()
+	}
+
+	var matches []string
+	if function, ok := functions[s.function]; ok {
+		os.Unsetenv("COMPREPLY")
+		callFunction(function, args, &Streams{Stdin: closedStream{}, Stdout: io.Discard, Stderr: os.Stderr})
+		reply, _ := lookupVar("COMPREPLY")
+		os.Unsetenv("COMPREPLY")
+		matches = append(matches, completionLines(reply)...)
+	}
+	if s.command != "" {
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = quoteWord(arg)
+		}
+		output := CommandSubstitution(s.command + " " + strings.Join(quoted, " ") + " </dev/null")
+		matches = append(matches, completionLines(output)...)
+	}
+	return matches
+}
+
+// completionLines returns the non-empty lines of s.
+func completionLines(s string) []string {
+	var lines []string
+	for line := range strings.SplitSeq(s, "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// completeAction returns the names of the kind action that start with word.
+func completeAction(action string, word string) []string {
+	var names []string
+	switch action {
+	case "builtin":
+		names = slices.Sorted(maps.Keys(ShellBuiltinCommands))
+	case "command":
+		if strings.Contains(word, "/") {
+			return completePath(word, true)
+		}
+		names = slices.Concat(slices.Sorted(maps.Keys(ShellBuiltinCommands)), slices.Sorted(maps.Keys(functions)),
+			slices.Sorted(maps.Keys(reservedWords)), SearchAllExecutable(word))
+	case "directory":
+		return trimSlashes(completeDirectories(word))
+	case "file":
+		return trimSlashes(completePath(word, false))
+	case "function":
+		names = slices.Sorted(maps.Keys(functions))
+	case "keyword":
+		names = slices.Sorted(maps.Keys(reservedWords))
+	case "signal":
+		for name := range trapSignals {
+			names = append(names, "SIG"+name)
+		}
+		slices.Sort(names)
+	case "job":
+		for _, job := range jobs {
+			names = append(names, job.command)
+		}
+	case "variable", "export":
+		// the variables of the shell are its environment
+		for _, variable := range os.Environ() {
+			name, _, _ := strings.Cut(variable, "=")
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	case "user":
+		names = fileFields("/etc/passwd", func(line string) []string {
+			name, _, _ := strings.Cut(line, ":")
+			return []string{name}
+		})
+	case "hostname":
+		hosts := os.Getenv("HOSTFILE")
+		if hosts == "" {
+			hosts = "/etc/hosts"
+		}
+		names = fileFields(hosts, func(line string) []string {
+			line, _, _ = strings.Cut(line, "#")
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return nil
+			}
+			return fields[1:]
+		})
+	}
+	return slices.DeleteFunc(names, func(name string) bool { return !strings.HasPrefix(name, word) })
+}
+
+// completeDirectories returns the directories that start with prefix.
+func completeDirectories(prefix string) []string {
+	return slices.DeleteFunc(completePath(prefix, false), func(path string) bool {
+		return !strings.HasSuffix(path, "/")
+	})
+}
+
+func trimSlashes(paths []string) []string {
+	for i, path := range paths {
+		paths[i] = strings.TrimSuffix(path, "/")
+	}
+	return paths
+}
+
+// fileFields returns the names fields finds on the lines of the file at
+// path.
+func fileFields(path string, fields func(line string) []string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		names = append(names, fields(scanner.Text())...)
+	}
+	return names
+}
+
+// String returns the complete command that registers the spec for name.
+func (s *completionSpec) String(name string) string {
+	var b strings.Builder
+	b.WriteString("complete")
+	for _, option := range completionOptions {
+		if s.options[option] {
+			b.WriteString(" -o " + option)
+		}
+	}
+	for _, action := range s.actions {
+		if letter, ok := actionLetter(action); ok {
+			b.WriteString(" -" + string(letter))
+		} else {
+			b.WriteString(" -A " + action)
+		}
+	}
+	for _, option := range []struct {
+		letter byte
+		value  string
+	}{{'G', s.glob}, {'W', s.words}, {'X', s.filter}, {'P', s.prefix}, {'S', s.suffix}, {'C', s.command}} {
+		if option.value != "" {
+			fmt.Fprintf(&b, " -%c %s", option.letter, quoteWord(option.value))
+		}
+	}
+	if s.function != "" {
+		b.WriteString(" -F " + s.function)
+	}
+	if name == "" {
+		b.WriteString(" -D")
+	} else {
+		b.WriteString(" " + name)
+	}
+	return b.String()
+}
+
+func actionLetter(action string) (byte, bool) {
+	for letter, name := range completionActions {
+		if name == action {
+			return letter, true
+		}
+	}
+	return 0, false
+}
+
+// errCompletionUsage is returned for invalid options of complete and
+// compgen, after printing why.
+var errCompletionUsage = errors.New("usage")
+
+// parseCompletionSpec parses the options of the complete and compgen
+// builtins into a spec. The letters in flags are the options with no
+// argument the builtin takes besides the ones of specs, and the ones found
+// are returned along with the arguments left.
+func parseCompletionSpec(name string, args []string, flags string, stderr io.Writer) (*completionSpec, map[byte]bool, []string, error) {
+	spec := &completionSpec{options: map[string]bool{}}
+	found := map[byte]bool{}
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		option := args[0]
+		args = args[1:]
+		if option == "--" {
+			break
+		}
+		for i := 1; i < len(option); i++ {
+			letter := option[i]
+			if action, ok := completionActions[letter]; ok {
+				spec.actions = append(spec.actions, action)
+				continue
+			}
+			if strings.IndexByte(flags, letter) >= 0 {
+				found[letter] = true
+				continue
+			}
+			if strings.IndexByte("AoGWFCXPS", letter) < 0 {
+				fmt.Fprintf(stderr, "%s: -%c: invalid option\n", name, letter)
+				return nil, nil, nil, errCompletionUsage
+			}
+
+			// the argument follows the letter or is the next one
+			value := option[i+1:]
+			if value == "" {
+				if len(args) == 0 {
+					fmt.Fprintf(stderr, "%s: -%c: option requires an argument\n", name, letter)
+					return nil, nil, nil, errCompletionUsage
+				}
+				value, args = args[0], args[1:]
+			}
+			switch letter {
+			case 'A':
+				if !slices.Contains(completionActionNames, value) {
+					fmt.Fprintf(stderr, "%s: %s: invalid action name\n", name, value)
+					return nil, nil, nil, ExitStatus(1)
+				}
+				spec.actions = append(spec.actions, value)
+			case 'o':
+				if !slices.Contains(completionOptions, value) {
+					fmt.Fprintf(stderr, "%s: %s: invalid option name\n", name, value)
+					return nil, nil, nil, ExitStatus(1)
+				}
+				spec.options[value] = true
+			case 'G':
+				spec.glob = value
+			case 'W':
+				spec.words = value
+			case 'F':
+				spec.function = value
+			case 'C':
+				spec.command = value
+			case 'X':
+				spec.filter = value
+			case 'P':
+				spec.prefix = value
+			case 'S':
+				spec.suffix = value
+			}
+			i = len(option)
+		}
+	}
+	return spec, found, args, nil
+}
+
+// completeBuiltin registers how Tab completes the arguments of commands.
+//
+//	complete [-bcdefjkuv] [-A action] [-o option] [-G glob] [-W words]
+//	         [-F function] [-C command] [-X filter] [-P prefix] [-S suffix]
+//	         [-D] name...
+//
+// -p prints the specs of the names, or all of them, and -r removes them.
+// -D sets the spec of the commands that have none.
+func completeBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	spec, flags, names, err := parseCompletionSpec("complete", args, "prD", stderr)
+	if err == errCompletionUsage {
+		fmt.Fprintln(stderr, "complete: usage: complete [-abcdefgjksuv] [-pr] [-DEI] [-o option] [-A action] [-G globpat] [-W wordlist] [-F function] [-C command] [-X filterpat] [-P prefix] [-S suffix] [name ...]")
+		return ExitStatus(2)
+	}
+	if err != nil {
+		return err
+	}
+	if flags['D'] {
+		names = append(names, "")
+	}
+
+	switch {
+	case flags['r']:
+		if len(names) == 0 {
+			clear(completionSpecs)
+			return nil
+		}
+		return forEachCompletionSpec(names, stderr, func(name string, spec *completionSpec) {
+			delete(completionSpecs, name)
+		})
+	case flags['p'] || len(args) == 0:
+		if len(names) == 0 {
+			names = slices.Sorted(maps.Keys(completionSpecs))
+		}
+		return forEachCompletionSpec(names, stderr, func(name string, spec *completionSpec) {
+			fmt.Fprintln(stdout, spec.String(name))
+		})
+	case len(names) == 0:
+		fmt.Fprintln(stderr, "complete: no command names given")
+		return ExitStatus(2)
+	}
+	for _, name := range names {
+		completionSpecs[name] = spec
+	}
+	return nil
+}
+
+// forEachCompletionSpec calls do with the spec of each of names, and fails
+// for the names that have none.
+func forEachCompletionSpec(names []string, stderr io.Writer, do func(name string, spec *completionSpec)) error {
+	var err error
+	for _, name := range names {
+		spec, ok := completionSpecs[name]
+		if !ok {
+			fmt.Fprintf(stderr, "complete: %s: no completion specification\n", name)
+			err = ExitStatus(1)
+			continue
+		}
+		do(name, spec)
+	}
+	return err
+}
+
+// compgenBuiltin prints the completions of a word, an empty one by default,
+// with the options of complete, one per line. It fails when there are none.
+func compgenBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	spec, _, args, err := parseCompletionSpec("compgen", args, "", stderr)
+	if err == errCompletionUsage {
+		fmt.Fprintln(stderr, "compgen: usage: compgen [-abcdefgjksuv] [-o option] [-A action] [-G globpat] [-W wordlist] [-F function] [-C command] [-X filterpat] [-P prefix] [-S suffix] [word]")
+		return ExitStatus(2)
+	}
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		fmt.Fprintln(stderr, "compgen: too many arguments")
+		return ExitStatus(2)
+	}
+	word := ""
+	if len(args) > 0 {
+		word = args[0]
+	}
+
+	matches := spec.generate(word, nil)
+	if len(matches) == 0 {
+		return ExitStatus(1)
+	}
+	for _, match := range matches {
+		fmt.Fprintln(stdout, match)
+	}
+	return nil
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Keys that the terminal sends as escape sequences, numbered after the
+// characters so that both fit in one key code.
+const (
+	keyUp = unicode.MaxRune + 1 + iota
+	keyDown
+	keyRight
+	keyLeft
+	keyHome
+	keyEnd
+	keyDelete
+	keyWordLeft
+	keyWordRight
+	keyUnknown
+)
+
+// Control keys the line editor handles.
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlH     = 8
+	keyCtrlK     = 11
+	keyCtrlG     = 7
+	keyCtrlL     = 12
+	keyCtrlR     = 18
+	keyCtrlS     = 19
+	keyCtrlT     = 20
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyCtrlY     = 25
+	keyEscape    = 27
+	keyBackspace = 127
+)
+
+// readKey reads a key from the terminal: a character, decoded from UTF-8,
+// or the key code of the escape sequences of the arrows, Home, End, Delete
+// and Alt-B/F. Other escape sequences are read whole and returned as
+// keyUnknown.
+func readKey(r *bufio.Reader) (int, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return int(c), err
+	}
+	if c >= utf8.RuneSelf {
+		return readRune(r, c)
+	}
+	if c != keyEscape {
+		return int(c), nil
+	}
+
+	// a lone Escape comes alone, escape sequences in one piece
+	if r.Buffered() == 0 {
+		return keyEscape, nil
+	}
+	c, err = r.ReadByte()
+	if err != nil {
+		return keyEscape, err
+	}
+	switch c {
+	case 'b', 'B':
+		return keyWordLeft, nil
+	case 'f', 'F':
+		return keyWordRight, nil
+	case 'O':
+		// ESC O x, sent by some terminals in application mode
+		c, err := r.ReadByte()
+		if err != nil {
+			return keyUnknown, err
+		}
+		return csiKey("", c), nil
+	case '[':
+		// ESC [ parameters final, the parameters being digits and ';'
+		var params strings.Builder
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return keyUnknown, err
+			}
+			if c >= 0x40 && c <= 0x7e {
+				return csiKey(params.String(), c), nil
+			}
+			params.WriteByte(c)
+		}
+	}
+	return keyUnknown, nil
+}
+
+// readRune reads the rest of the UTF-8 encoded character that starts with
+// the byte first. An invalid encoding gives utf8.RuneError.
+func readRune(r *bufio.Reader, first byte) (int, error) {
+	var size int
+	switch {
+	case first&0xe0 == 0xc0:
+		size = 2
+	case first&0xf0 == 0xe0:
+		size = 3
+	case first&0xf8 == 0xf0:
+		size = 4
+	default:
+		return utf8.RuneError, nil
+	}
+
+	encoded := []byte{first}
+	for len(encoded) < size {
+		c, err := r.ReadByte()
+		if err != nil {
+			return utf8.RuneError, err
+		}
+		if !utf8.RuneStart(c) {
+			encoded = append(encoded, c)
+			continue
+		}
+		// not a continuation byte: leave it for the next key
+		r.UnreadByte()
+		return utf8.RuneError, nil
+	}
+	rn, _ := utf8.DecodeRune(encoded)
+	return int(rn), nil
+}
+
+// csiKey returns the key of the escape sequence with the given parameters
+// and final byte.
+func csiKey(params string, final byte) int {
+	switch final {
+	case 'A':
+		return keyUp
+	case 'B':
+		return keyDown
+	case 'C':
+		// Ctrl and Alt with Right move by words, as in ESC [ 1 ; 5 C
+		if strings.HasSuffix(params, ";5") || strings.HasSuffix(params, ";3") {
+			return keyWordRight
+		}
+		return keyRight
+	case 'D':
+		if strings.HasSuffix(params, ";5") || strings.HasSuffix(params, ";3") {
+			return keyWordLeft
+		}
+		return keyLeft
+	case 'H':
+		return keyHome
+	case 'F':
+		return keyEnd
+	case '~':
+		switch params {
+		case "1", "7":
+			return keyHome
+		case "4", "8":
+			return keyEnd
+		case "3":
+			return keyDelete
+		}
+	}
+	return keyUnknown
+}
+
+// lineEditor holds the line typed at the prompt and the cursor in it, and
+// keeps the terminal showing them. The cursor counts characters, which may
+// take zero, one or two columns on the screen; a character followed by
+// zero width ones, like combining accents, is edited as a whole. A line
+// longer than the terminal is wide wraps onto the rows below the prompt.
+type lineEditor struct {
+	out    io.Writer
+	prompt string
+	buf    []rune
+	pos    int
+
+	// width returns the number of columns of the terminal, or 0 when it is
+	// not known, in which case the line is taken not to wrap
+	width func() int
+
+	// row is the screen row the cursor is on, counted from the row the
+	// prompt ends on
+	row int
+
+	// killed is the text last removed with Ctrl-W, Ctrl-U or Ctrl-K, which
+	// Ctrl-Y puts back
+	killed string
+
+	// lastSearch is the query of the last history search, which Ctrl-R or
+	// Ctrl-S search again for when the new query is empty
+	lastSearch string
+}
+
+func newLineEditor(out io.Writer) *lineEditor {
+	return &lineEditor{out: out, width: func() int { return 0 }}
+}
+
+func (e *lineEditor) String() string {
+	return string(e.buf)
+}
+
+// set replaces the line, leaving the cursor at its end.
+func (e *lineEditor) set(line string) {
+	e.buf = []rune(line)
+	e.pos = len(e.buf)
+	e.refresh()
+}
+
+// reset empties the line without redrawing it, for a new prompt.
+func (e *lineEditor) reset() {
+	e.buf = e.buf[:0]
+	e.pos = 0
+	e.row = 0
+}
+
+// finish moves the cursor past the end of the line and onto the next row,
+// for the command to run or something else to be printed below the line.
+func (e *lineEditor) finish() {
+	e.moveTo(len(e.buf))
+	fmt.Fprint(e.out, "\r\n")
+	e.row = 0
+}
+
+// refresh redraws the prompt and the line and puts the cursor back.
+func (e *lineEditor) refresh() {
+	e.draw(e.promptLine(), display(e.buf), e.buf, e.pos)
+}
+
+// draw replaces the rows of the line with prefix, the prompt or the label
+// of a history search, followed by shown, which is text as it appears on
+// the screen, and puts the cursor after the first n characters of text.
+func (e *lineEditor) draw(prefix string, shown string, text []rune, n int) {
+	if e.row > 0 {
+		fmt.Fprintf(e.out, "\033[%dA", e.row)
+	}
+	fmt.Fprintf(e.out, "\r%s%s", prefix, shown)
+
+	start := visibleWidth(prefix)
+	row, col := e.screenPos(start, text)
+	if row > 0 && col == 0 {
+		// the terminal only moves to the next row when something is
+		// written past the last column
+		fmt.Fprint(e.out, "\r\n")
+	}
+	fmt.Fprint(e.out, "\033[J")
+	e.row = row
+	e.goTo(e.screenPos(start, text[:n]))
+}
+
+// promptLine returns the last line of the prompt, the one the line is typed
+// on, which is all of the prompt that is redrawn.
+func (e *lineEditor) promptLine() string {
+	return e.prompt[strings.LastIndex(e.prompt, "\n")+1:]
+}
+
+// cursorPos returns the row and column of the screen where the character
+// at pos is drawn.
+func (e *lineEditor) cursorPos(pos int) (int, int) {
+	return e.screenPos(visibleWidth(e.promptLine()), e.buf[:pos])
+}
+
+// screenPos returns the row and column of the screen that text ends on when
+// drawn from column start of the first row. A character that does not fit
+// at the end of a row goes to the next one, as the terminal draws it.
+func (e *lineEditor) screenPos(start int, text []rune) (row, col int) {
+	width := e.width()
+	col = start
+	if width > 0 {
+		row, col = start/width, start%width
+	}
+	for _, r := range text {
+		n := cellWidth(r)
+		if width > 0 && col+n > width {
+			row, col = row+1, 0
+		}
+		col += n
+	}
+	if width > 0 && col >= width {
+		row, col = row+1, 0
+	}
+	return row, col
+}
+
+// goTo moves the cursor to row and col of the screen.
+func (e *lineEditor) goTo(row, col int) {
+	if row < e.row {
+		fmt.Fprintf(e.out, "\033[%dA", e.row-row)
+	} else if row > e.row {
+		fmt.Fprintf(e.out, "\033[%dB", row-e.row)
+	}
+	fmt.Fprint(e.out, "\r")
+	if col > 0 {
+		fmt.Fprintf(e.out, "\033[%dC", col)
+	}
+	e.row = row
+}
+
+// edit applies an editing key to the line and reports whether it was one.
+func (e *lineEditor) edit(key int) bool {
+	switch key {
+	case keyLeft, keyCtrlB:
+		e.moveTo(e.previous(e.pos))
+	case keyRight, keyCtrlF:
+		e.moveTo(e.next(e.pos))
+	case keyHome, keyCtrlA:
+		e.moveTo(0)
+	case keyEnd, keyCtrlE:
+		e.moveTo(len(e.buf))
+	case keyWordLeft:
+		e.moveTo(e.wordStart())
+	case keyWordRight:
+		e.moveTo(e.wordEnd())
+	case keyBackspace, keyCtrlH:
+		if e.pos > 0 {
+			e.delete(e.previous(e.pos), e.pos)
+		}
+	case keyDelete:
+		if e.pos < len(e.buf) {
+			e.delete(e.pos, e.next(e.pos))
+		}
+	case keyCtrlW:
+		// like readline, Ctrl-W kills back to whitespace
+		start := e.pos
+		for start > 0 && e.buf[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && e.buf[start-1] != ' ' {
+			start--
+		}
+		e.kill(start, e.pos)
+	case keyCtrlU:
+		e.kill(0, e.pos)
+	case keyCtrlK:
+		e.kill(e.pos, len(e.buf))
+	case keyCtrlY:
+		e.insert(e.killed)
+	case keyCtrlT:
+		e.transpose()
+	case keyCtrlL:
+		fmt.Fprint(e.out, "\033[H\033[2J")
+		e.row = 0
+		e.refresh()
+	default:
+		r := rune(key)
+		if key < ' ' || key > unicode.MaxRune || r == utf8.RuneError || !unicode.IsPrint(r) && runeWidth(r) > 0 {
+			return false
+		}
+		e.insert(string(r))
+	}
+	return true
+}
+
+// insert types s at the cursor.
+func (e *lineEditor) insert(s string) {
+	if s == "" {
+		return
+	}
+	runes := []rune(s)
+	e.buf = append(e.buf[:e.pos], append(runes, e.buf[e.pos:]...)...)
+	e.pos += len(runes)
+	if e.pos == len(e.buf) {
+		// typing at the end of the line needs no redraw
+		fmt.Fprint(e.out, display(runes))
+		row, col := e.cursorPos(e.pos)
+		if row > e.row && col == 0 {
+			fmt.Fprint(e.out, "\r\n")
+		}
+		e.row = row
+		return
+	}
+	e.refresh()
+}
+
+// replace puts s in place of the text between start and the cursor.
+func (e *lineEditor) replace(start int, s string) {
+	e.buf = append(e.buf[:start], append([]rune(s), e.buf[e.pos:]...)...)
+	e.pos = start + len([]rune(s))
+	e.refresh()
+}
+
+// delete removes the text between start and end, which contains the cursor.
+func (e *lineEditor) delete(start, end int) {
+	e.buf = append(e.buf[:start], e.buf[end:]...)
+	e.pos = start
+	e.refresh()
+}
+
+// kill deletes the text between start and end and keeps it for Ctrl-Y.
+func (e *lineEditor) kill(start, end int) {
+	if start == end {
+		return
+	}
+	e.killed = string(e.buf[start:end])
+	e.delete(start, end)
+}
+
+// transpose swaps the characters before and at the cursor and moves past
+// them; at the end of the line it swaps the last two.
+func (e *lineEditor) transpose() {
+	middle := e.pos
+	if middle == len(e.buf) {
+		middle = e.previous(middle)
+	}
+	if middle == 0 || middle == len(e.buf) {
+		fmt.Fprint(e.out, bell)
+		return
+	}
+	start, end := e.previous(middle), e.next(middle)
+	swapped := append(append([]rune{}, e.buf[middle:end]...), e.buf[start:middle]...)
+	copy(e.buf[start:end], swapped)
+	e.pos = end
+	e.refresh()
+}
+
+// moveTo moves the cursor to pos, when it is in the line.
+func (e *lineEditor) moveTo(pos int) {
+	if pos < 0 || pos > len(e.buf) || pos == e.pos {
+		return
+	}
+	e.goTo(e.cursorPos(pos))
+	e.pos = pos
+}
+
+// previous returns the position of the character before pos, skipping the
+// zero width characters drawn with it.
+func (e *lineEditor) previous(pos int) int {
+	for pos > 0 {
+		pos--
+		if runeWidth(e.buf[pos]) > 0 {
+			break
+		}
+	}
+	return pos
+}
+
+// next returns the position after the character at pos and the zero width
+// characters that follow it.
+func (e *lineEditor) next(pos int) int {
+	if pos < len(e.buf) {
+		pos++
+	}
+	for pos < len(e.buf) && runeWidth(e.buf[pos]) == 0 {
+		pos++
+	}
+	return pos
+}
+
+// wordStart returns the start of the word before the cursor, words being
+// made of letters, digits and the marks that go with them.
+func (e *lineEditor) wordStart() int {
+	pos := e.pos
+	for pos > 0 && !isWordRune(e.buf[pos-1]) {
+		pos--
+	}
+	for pos > 0 && isWordRune(e.buf[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+// wordEnd returns the end of the word after the cursor.
+func (e *lineEditor) wordEnd() int {
+	pos := e.pos
+	for pos < len(e.buf) && !isWordRune(e.buf[pos]) {
+		pos++
+	}
+	for pos < len(e.buf) && isWordRune(e.buf[pos]) {
+		pos++
+	}
+	return pos
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// searchHistory runs the incremental history search of Ctrl-R, or of Ctrl-S
+// when forward is set, reading keys until one ends it. Ctrl-R and Ctrl-S
+// look for older and newer matches of the query, Ctrl-G and Ctrl-C give the
+// line back as it was, and the other keys put the match in the line, at the
+// history position of the match. It returns the key that ended the search
+// for the REPL to handle, like Enter to run the match, or 0 when there is
+// nothing left to do.
+func (e *lineEditor) searchHistory(hist *History, r *bufio.Reader, histIndex *int, forward bool) (int, error) {
+	original, originalPos := e.String(), e.pos
+	var query []rune
+	// the match is highlighted from offset to end, and offset is -1 before
+	// there is one
+	match, index, offset, end := original, hist.GetHistoryIndex(), -1, 0
+	failed := false
+
+	// search looks for the query from start on
+	search := func(start int) {
+		i, off, ok := hist.Search(string(query), start, forward)
+		failed = !ok
+		if ok {
+			match, index, offset, end = hist.Get(i), i, off, off+len(string(query))
+		}
+	}
+
+	for {
+		e.drawSearch(string(query), match, offset, end, failed, forward)
+		key, err := readKey(r)
+		if err != nil {
+			return key, err
+		}
+
+		switch key {
+		case keyCtrlR, keyCtrlS:
+			if len(query) == 0 {
+				query = []rune(e.lastSearch)
+			}
+			forward = key == keyCtrlS
+			start := index
+			if offset >= 0 {
+				// look past the match
+				start = index - 1
+				if forward {
+					start = index + 1
+				}
+			}
+			if len(query) > 0 {
+				search(start)
+			}
+		case keyBackspace, keyCtrlH:
+			if len(query) == 0 {
+				break
+			}
+			query = query[:len(query)-1]
+			match, index, offset = original, hist.GetHistoryIndex(), -1
+			failed = false
+			if len(query) > 0 {
+				search(index)
+			}
+		case keyCtrlG, keyCtrlC:
+			e.buf, e.pos = []rune(original), originalPos
+			e.refresh()
+			if key == keyCtrlC {
+				return key, nil
+			}
+			return 0, nil
+		default:
+			rn := rune(key)
+			if key >= ' ' && key <= unicode.MaxRune && unicode.IsPrint(rn) {
+				query = append(query, rn)
+				search(index)
+				break
+			}
+
+			// any other key accepts the match
+			if len(query) > 0 {
+				e.lastSearch = string(query)
+			}
+			e.buf = []rune(match)
+			e.pos = len(e.buf)
+			if offset >= 0 {
+				e.pos = len([]rune(match[:offset]))
+				*histIndex = index
+			}
+			e.refresh()
+			if key == keyEscape {
+				return 0, nil
+			}
+			return key, nil
+		}
+	}
+}
+
+// drawSearch shows the state of a history search in place of the line, with
+// the match of the query highlighted and the cursor on it.
+func (e *lineEditor) drawSearch(query string, match string, offset, end int, failed bool, forward bool) {
+	label := "reverse-i-search"
+	if forward {
+		label = "i-search"
+	}
+	if failed {
+		label = "failed " + label
+	}
+	prefix := fmt.Sprintf("(%s)'%s': ", label, query)
+	text := []rune(match)
+	if offset < 0 {
+		e.draw(prefix, display(text), text, len(text))
+		return
+	}
+	shown := display([]rune(match[:offset])) + Reverse + display([]rune(match[offset:end])) + Reset + display([]rune(match[end:]))
+	e.draw(prefix, shown, text, len([]rune(match[:offset])))
+}
+
+// cellWidth returns the number of columns r takes on the screen. Control
+// characters, like the newlines of a command recalled from the history,
+// are shown as ^J and the like to keep the line on its rows.
+func cellWidth(r rune) int {
+	if r < ' ' || r == 0x7f {
+		return 2
+	}
+	return runeWidth(r)
+}
+
+// display returns text as it is shown on the screen.
+func display(text []rune) string {
+	var shown strings.Builder
+	for _, r := range text {
+		if r < ' ' || r == 0x7f {
+			shown.WriteByte('^')
+			shown.WriteByte(byte(r) ^ 0x40)
+			continue
+		}
+		shown.WriteRune(r)
+	}
+	return shown.String()
+}
+
+// visibleWidth returns the number of columns s takes on the screen, leaving
+// out the escape sequences of colors and the like.
+func visibleWidth(s string) int {
+	width := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == keyEscape && i+1 < len(s) && s[i+1] == '[' {
+			i += 2
+			for i < len(s) && (s[i] < 0x40 || s[i] > 0x7e) {
+				i++
+			}
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		width += runeWidth(r)
+		i += size - 1
+	}
+	return width
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineEditor(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		keys     string
+		expected string
+		cursor   int
+	}{
+		{"Typing", "echo hi", "echo hi", 7},
+		{"Insert In The Middle", "echo wrld\x1b[D\x1b[D\x1b[Do", "echo world", 7},
+		{"Home And End", "bc\x01a\x05d", "abcd", 4},
+		{"Home And End Variants", "b\x1b[1~a\x1b[4~c\x1b[Hx\x1b[Fy\x1bOHz\x1bOF", "zxabcy", 6},
+		{"Backspace", "echo hix\x7f", "echo hi", 7},
+		{"Backspace In The Middle", "ecxho\x02\x02\x7f", "echo", 2},
+		{"Delete", "xecho\x01\x1b[3~", "echo", 0},
+		{"Word Movement", "echo one two\x1bb\x1bbX\x1bfY", "echo XoneY two", 10},
+		{"Ctrl Arrows Move By Words", "echo one\x1b[1;5D\x1b[1;5D\x1b[1;5C", "echo one", 4},
+		{"Kill Word", "echo one two  \x17", "echo one ", 9},
+		{"Kill To Start And Yank", "echo hi\x15X\x19", "Xecho hi", 8},
+		{"Kill To End", "echo hi\x01\x06\x06\x0b", "ec", 2},
+		{"Transpose", "ecoh\x02\x14", "echo", 4},
+		{"Transpose At The End", "ehco\x02\x02\x14\x05\x14", "ecoh", 4},
+		{"Unknown Sequence", "a\x1b[5~b", "ab", 2},
+		{"Backspace Over Multi-byte Characters", "café\x7f\x7fé", "caé", 3},
+		{"Wide Characters", "日本x\x1b[D\x1b[D語", "日語本x", 2},
+		{"Combining Marks Go With Their Character", "e\u0301ae\u0301\x01\x1b[3~\x05\x7f", "a", 1},
+		{"Transpose Wide Characters", "ab日\x14", "a日b", 3},
+		{"Emoji", "😀x\x01\x06z", "😀zx", 2},
+		{"Words Of Non-ASCII Letters", "ls été naïve\x1bb\x1bb", "ls été naïve", 3},
+		{"Invalid UTF-8", "a\xffb\xc3", "ab", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.keys))
+			line := newLineEditor(io.Discard)
+			for {
+				key, err := readKey(reader)
+				if err != nil {
+					break
+				}
+				line.edit(key)
+			}
+			if line.String() != tt.expected || line.pos != tt.cursor {
+				t.Errorf("%q left %q with the cursor at %d, expected: %q at %d", tt.keys, line.String(), line.pos, tt.expected, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestHistorySearch(t *testing.T) {
+
+	hist := historyOf("echo alpha", "echo beta", "echo alpine")
+
+	tests := []struct {
+		name     string
+		keys     string
+		key      int
+		expected string
+		cursor   int
+		index    int
+	}{
+		{"Newest Match", "al\r", '\r', "echo alpine", 5, 2},
+		{"Older Match", "al\x12\r", '\r', "echo alpha", 5, 0},
+		{"Forward Again", "al\x12\x12\x13\r", '\r', "echo alpine", 5, 2},
+		{"Failed Search Keeps The Match", "alx\r", '\r', "echo alpine", 5, 2},
+		{"Backspace", "alx\x7f\x7f\x7fb\r", '\r', "echo beta", 5, 1},
+		{"Cancel", "be\x07", 0, "ls", 1, 3},
+		{"Interrupt", "be\x03", keyCtrlC, "ls", 1, 3},
+		{"Arrow Accepts The Match", "eta\x1b[D", keyLeft, "echo beta", 6, 1},
+		{"Escape Accepts The Match", "ph\x1b", 0, "echo alpha", 7, 0},
+		{"No Match", "zz\r", '\r', "ls", 2, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := newLineEditor(io.Discard)
+			line.set("ls")
+			line.moveTo(1)
+			histIndex := hist.GetHistoryIndex()
+			key, err := line.searchHistory(hist, bufio.NewReader(strings.NewReader(tt.keys)), &histIndex, false)
+			if err != nil || key != tt.key {
+				t.Errorf("%q ended the search with %d, %v, expected: %d", tt.keys, key, err, tt.key)
+			}
+			if line.String() != tt.expected || line.pos != tt.cursor || histIndex != tt.index {
+				t.Errorf("%q left %q with the cursor at %d and history at %d, expected: %q at %d and %d",
+					tt.keys, line.String(), line.pos, histIndex, tt.expected, tt.cursor, tt.index)
+			}
+		})
+	}
+
+	line := newLineEditor(io.Discard)
+	var histIndex int
+	line.searchHistory(hist, bufio.NewReader(strings.NewReader("beta\r")), &histIndex, false)
+	line.reset()
+	line.searchHistory(hist, bufio.NewReader(strings.NewReader("\x12\r")), &histIndex, false)
+	if line.String() != "echo beta" {
+		t.Errorf("an empty search found %q, expected the last search to be repeated", line.String())
+	}
+}
+
+// screen is a terminal of the given width that understands what the line
+// editor writes: text, carriage returns, newlines and the escape sequences
+// that move the cursor and clear the screen.
+type screen struct {
+	width    int
+	rows     [][]rune
+	row, col int
+	// wrap is set once the last column of a row is written: like a real
+	// terminal, the screen only moves to the next row when more text comes
+	wrap bool
+}
+
+func (s *screen) Write(p []byte) (int, error) {
+	text := []rune(string(p))
+	for i := 0; i < len(text); i++ {
+		switch r := text[i]; r {
+		case '\r':
+			s.col, s.wrap = 0, false
+		case '\n':
+			s.row, s.wrap = s.row+1, false
+		case keyEscape:
+			i += 2
+			n := 0
+			for ; text[i] >= '0' && text[i] <= '9'; i++ {
+				n = n*10 + int(text[i]-'0')
+			}
+			n = max(n, 1)
+			switch text[i] {
+			case 'A':
+				s.row = max(s.row-n, 0)
+			case 'B':
+				s.row += n
+			case 'C':
+				s.col = min(s.col+n, s.width-1)
+			case 'J':
+				if s.row < len(s.rows) {
+					s.rows[s.row] = s.rows[s.row][:min(s.col, len(s.rows[s.row]))]
+					s.rows = s.rows[:s.row+1]
+				}
+			}
+			s.wrap = false
+		default:
+			width := runeWidth(r)
+			if s.wrap || s.col+width > s.width {
+				s.row, s.col, s.wrap = s.row+1, 0, false
+			}
+			for len(s.rows) <= s.row {
+				s.rows = append(s.rows, nil)
+			}
+			for len(s.rows[s.row]) < s.col+width {
+				s.rows[s.row] = append(s.rows[s.row], ' ')
+			}
+			s.rows[s.row][s.col] = r
+			if width == 2 {
+				s.rows[s.row][s.col+1] = 0
+			}
+			s.col += width
+			if s.col == s.width {
+				s.col, s.wrap = s.width-1, true
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (s *screen) String() string {
+	var rows []string
+	for _, row := range s.rows {
+		rows = append(rows, strings.TrimRight(strings.ReplaceAll(string(row), "\x00", ""), " "))
+	}
+	return strings.Join(rows, "\n")
+}
+
+func TestLineEditorWraps(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		line     string
+		keys     string
+		expected string
+		row, col int
+	}{
+		{"Long Line", "", "echo 1234567890", "$ echo 123\n4567890", 1, 7},
+		{"Line Filling The Row", "", "echo 123", "$ echo 123", 1, 0},
+		{"Typing On The Next Row", "", "echo 123x", "$ echo 123\nx", 1, 1},
+		{"Insert On The First Row", "", "echo 1234567890\x01X", "$ Xecho 12\n34567890", 0, 3},
+		{"Moving Across Rows", "", "echo 1234567890\x01\x1bf\x1bf\x02", "$ echo 123\n4567890", 1, 6},
+		{"Backspace Across Rows", "", "echo 1234\x7f\x7f", "$ echo 12", 0, 9},
+		{"Shorter Line Clears The Rows Below", "", "echo 1234567890 abcdefghij\x15", "$", 0, 2},
+		{"Wide Character At The End Of A Row", "", "echo 12日x", "$ echo 12\n日x", 1, 3},
+		{"Multi-line Command On One Line", "if a\nthen b\nfi", "\x01", "$ if a^Jth\nen b^Jfi", 0, 2},
+		{"Moving Past A Newline", "if a\nthen b\nfi", "\x01\x06\x06\x06\x06\x06x", "$ if a^Jxt\nhen b^Jfi", 0, 9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terminal := &screen{width: 10}
+			line := newLineEditor(terminal)
+			line.width = func() int { return terminal.width }
+			line.prompt = "$ "
+			fmt.Fprint(terminal, line.prompt)
+			if tt.line != "" {
+				line.set(tt.line)
+			}
+
+			reader := bufio.NewReader(strings.NewReader(tt.keys))
+			for {
+				key, err := readKey(reader)
+				if err != nil {
+					break
+				}
+				line.edit(key)
+			}
+
+			if terminal.String() != tt.expected || terminal.row != tt.row || terminal.col != tt.col || terminal.wrap {
+				t.Errorf("%q showed %q with the cursor at %d,%d, expected: %q at %d,%d",
+					tt.keys, terminal.String(), terminal.row, terminal.col, tt.expected, tt.row, tt.col)
+			}
+
+			// the command output goes below the line
+			line.finish()
+			if terminal.row < len(terminal.rows) || terminal.col != 0 {
+				t.Errorf("finish left the cursor at %d,%d, expected it below the %d rows of the line", terminal.row, terminal.col, len(terminal.rows))
+			}
+		})
+	}
+
+	// the search label is wider than the terminal, and the match taken is
+	// drawn back in place of it
+	terminal := &screen{width: 10}
+	line := newLineEditor(terminal)
+	line.width = func() int { return terminal.width }
+	line.prompt = "$ "
+	fmt.Fprint(terminal, line.prompt)
+	histIndex := 0
+	line.searchHistory(historyOf("echo alpha", "echo beta"), bufio.NewReader(strings.NewReader("be\x1b")), &histIndex, false)
+	if expected := "$ echo bet\na"; terminal.String() != expected || terminal.row != 0 || terminal.col != 7 {
+		t.Errorf("the search left %q with the cursor at %d,%d, expected: %q at 0,7", terminal.String(), terminal.row, terminal.col, expected)
+	}
+}
@@ -1,63 +1,693 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
-func ExecuteCommand(input string) {
-	commands := Parse(strings.TrimSpace(input))
-	if len(commands) == 0 {
-		fmt.Printf("%s: not found\n", input)
-		return
+// Streams are the standard input, output and error a command line runs with
+// when its commands do not redirect them, along with the descriptors 3 to 9
+// opened by redirections such as `3>file`.
+type Streams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Extra  map[int]*os.File
+}
+
+// get returns the stream or file open as the descriptor fd, or nil.
+func (s *Streams) get(fd int) any {
+	switch fd {
+	case 0:
+		return s.Stdin
+	case 1:
+		return s.Stdout
+	case 2:
+		return s.Stderr
+	}
+	if file, ok := s.Extra[fd]; ok {
+		return file
+	}
+	return nil
+}
+
+// set opens stream as the descriptor fd. It reports whether stream can be
+// used as one: descriptors other than the standard ones need a file, and
+// the standard input and output need a reader and a writer.
+func (s *Streams) set(fd int, stream any) bool {
+	var ok bool
+	switch fd {
+	case 0:
+		s.Stdin, ok = stream.(io.Reader)
+	case 1:
+		s.Stdout, ok = stream.(io.Writer)
+	case 2:
+		s.Stderr, ok = stream.(io.Writer)
+	default:
+		var file *os.File
+		if file, ok = stream.(*os.File); ok {
+			if s.Extra == nil {
+				s.Extra = map[int]*os.File{}
+			}
+			s.Extra[fd] = file
+		}
+	}
+	return ok
+}
+
+// duplicate makes fd a copy of the descriptor named by target, as in
+// `2>&1`, or closes it when target is `-`.
+func (s *Streams) duplicate(fd int, target string) error {
+	if target == "-" {
+		if fd > 2 {
+			delete(s.Extra, fd)
+		} else {
+			s.set(fd, closedStream{})
+		}
+		return nil
+	}
+
+	source, err := strconv.Atoi(target)
+	if err != nil {
+		return fmt.Errorf("%s: ambiguous redirect", target)
+	}
+	if stream := s.get(source); stream == nil || !s.set(fd, stream) {
+		return fmt.Errorf("%d: %v", source, syscall.EBADF)
+	}
+	return nil
+}
+
+// closedStream stands for a standard descriptor closed with `>&-` or `<&-`.
+type closedStream struct{}
+
+func (closedStream) Read([]byte) (int, error) {
+	return 0, syscall.EBADF
+}
+
+func (closedStream) Write([]byte) (int, error) {
+	return 0, syscall.EBADF
+}
+
+func StandardStreams() *Streams {
+	return &Streams{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+}
+
+// lineInHistory is whether the command line run by ExecuteCommand was added
+// to the history, which HISTCONTROL and HISTIGNORE may prevent.
+var lineInHistory bool
+
+// ExecuteCommand runs a command line and returns its exit status, which is
+// also made available as `$?`.
+func ExecuteCommand(input string) int {
+	if interactive {
+		// the interactive shell expands history references and keeps the
+		// expanded line in its history
+		line, run, err := expandHistory(input, GetHistory())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", shellName, err)
+			return lastExitStatus
+		}
+		if line != input {
+			fmt.Println(line)
+		}
+		lineInHistory = GetHistory().Add(line)
+		if !run {
+			lineInHistory = false
+			return lastExitStatus
+		}
+		input = line
+		defer func() {
+			if lineInHistory {
+				GetHistory().Finish(line, lastExitStatus)
+			}
+			lineInHistory = false
+		}()
+	}
+	status := executeLine(input, StandardStreams())
+
+	// an interrupt only stops the command line it happened in
+	interrupted.Store(false)
+	if pendingFlow == flowInterrupt {
+		pendingFlow = flowNone
+	}
+	return status
+}
+
+// substitutionStatus is the exit status of the last command substitution,
+// which is the status of a command made only of assignments.
+var substitutionStatus int
+
+// CommandSubstitution runs input like ExecuteCommand and returns what it wrote
+// to its standard output, without trailing newlines. The output is read from
+// a pipe up to its end, so it includes what the background jobs started by
+// input write.
+func CommandSubstitution(input string) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", shellName, err)
+		return ""
+	}
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		r.Close()
+		output <- string(data)
+	}()
+
+	substitutionStatus = executeLine(input, &Streams{Stdin: os.Stdin, Stdout: w, Stderr: os.Stderr})
+	w.Close()
+	return strings.TrimRight(<-output, "\n")
+}
+
+func executeLine(input string, streams *Streams) int {
+	node, err := Parse(input)
+	if err != nil {
+		fmt.Fprintf(streams.Stderr, "%s: %v\n", shellName, err)
+		return setExitStatus(2)
+	}
+	if node == nil {
+		return lastExitStatus
+	}
+	return execute(node, streams)
+}
+
+// expansionFailed reports an expansion error, like `${VAR:?message}` with VAR
+// unset, and returns the status for it. A non-interactive shell exits on it,
+// as other shells do, rather than going on with the rest of the script.
+func expansionFailed(err error, streams *Streams) int {
+	fmt.Fprintf(streams.Stderr, "%s: %v\n", shellName, err)
+	if interactive {
+		return 1
+	}
+	if subshellLevel > 0 {
+		pendingFlow = flowExit
+		return 1
+	}
+	exitShell(1)
+	return 1
+}
+
+type flowKind int
+
+const (
+	flowNone flowKind = iota
+	flowExit
+	flowBreak
+	flowContinue
+	flowReturn
+	flowInterrupt
+)
+
+var (
+	// pendingFlow is set by builtins like `exit` that need the executor to stop
+	// running commands until the construct handling it is reached.
+	pendingFlow flowKind
+	// flowLevels is the number of enclosing loops a pending `break` or
+	// `continue` still has to leave.
+	flowLevels int
+	// subshellLevel counts the subshells we are in; `exit` only leaves the
+	// innermost one instead of the whole shell.
+	subshellLevel int
+	// loopLevel counts the loops we are in, which bounds `break n`.
+	loopLevel int
+)
+
+// execute walks the syntax tree, running every node with streams as its
+// default standard input, output and error, and returns the exit status.
+func execute(node SyntaxNode, streams *Streams) int {
+	runPendingTraps()
+	if checkInterrupt() {
+		return setExitStatus(128 + int(syscall.SIGINT))
+	}
+
+	switch node := node.(type) {
+	case *List:
+		status := 0
+		for _, item := range node.items {
+			status = execute(item, streams)
+			if pendingFlow != flowNone {
+				break
+			}
+		}
+		return status
+	case *Background:
+		return setExitStatus(executeBackground(node, streams))
+	case *AndOr:
+		status := executeCondition(node.left, streams)
+		if pendingFlow == flowNone && (node.operator == andIfToken) == (status == 0) {
+			status = execute(node.right, streams)
+		}
+		return status
+	case *Pipeline:
+		runTrap("DEBUG")
+		status := executePipeline(node.commands, streams)
+		if node.negated {
+			return setExitStatus(negate(status))
+		}
+		return setExitStatus(checkError(status))
+	case *Subshell:
+		return setExitStatus(executeSubshell(node, streams))
+	case *BraceGroup:
+		return setExitStatus(executeRedirected(node.redirections, streams, func(streams *Streams) int {
+			return execute(node.body, streams)
+		}))
+	case *IfClause:
+		return setExitStatus(executeRedirected(node.redirections, streams, func(streams *Streams) int {
+			return executeIf(node, streams)
+		}))
+	case *LoopClause:
+		return setExitStatus(executeRedirected(node.redirections, streams, func(streams *Streams) int {
+			return executeLoop(node, streams)
+		}))
+	case *ForClause:
+		return setExitStatus(executeRedirected(node.redirections, streams, func(streams *Streams) int {
+			return executeFor(node, streams)
+		}))
+	case *FunctionDefinition:
+		functions[node.name] = node
+		return setExitStatus(0)
+	case *CaseClause:
+		return setExitStatus(executeRedirected(node.redirections, streams, func(streams *Streams) int {
+			return executeCase(node, streams)
+		}))
+	default:
+		runTrap("DEBUG")
+		return setExitStatus(checkError(executePipeline([]SyntaxNode{node}, streams)))
+	}
+}
+
+// conditionLevel counts the conditions being run, like the one of an `if`,
+// whose failure does not trigger the ERR trap.
+var conditionLevel int
+
+func executeCondition(node SyntaxNode, streams *Streams) int {
+	conditionLevel++
+	defer func() { conditionLevel-- }()
+	return execute(node, streams)
+}
+
+// checkError runs the ERR trap when a command fails outside of a condition,
+// and returns its status. Like the other traps but RETURN, it is not run
+// inside functions, whose calls trigger it instead.
+func checkError(status int) int {
+	if status != 0 && conditionLevel == 0 && functionLevel == 0 {
+		setExitStatus(status)
+		runTrap("ERR")
+	}
+	return status
+}
+
+// executeSubshell runs the body of a subshell and then restores the working
+// directory and variables it may have changed.
+func executeSubshell(subshell *Subshell, streams *Streams) int {
+	restore := saveShellState()
+	defer restore()
+
+	subshellLevel++
+	defer func() {
+		subshellLevel--
+		if pendingFlow != flowInterrupt {
+			pendingFlow = flowNone
+		}
+	}()
+	return executeRedirected(subshell.redirections, streams, func(streams *Streams) int {
+		return execute(subshell.body, streams)
+	})
+}
+
+// executeRedirected runs the body of a compound command with its
+// redirections applied on top of streams.
+func executeRedirected(redirections []*Redirection, streams *Streams, body func(*Streams) int) int {
+	expanded, err := expandRedirections(redirections)
+	if err != nil {
+		return expansionFailed(err, streams)
+	}
+
+	resourceManager := &ResourceManager{}
+	defer resourceManager.CloseResources()
+
+	redirected, err := openRedirections(expanded, streams, resourceManager)
+	if err != nil {
+		fmt.Fprintf(streams.Stderr, "%s: %v\n", shellName, err)
+		return 1
+	}
+	return body(redirected)
+}
+
+func executeIf(clause *IfClause, streams *Streams) int {
+	status := executeCondition(clause.condition, streams)
+	switch {
+	case pendingFlow != flowNone:
+		return status
+	case status == 0:
+		return execute(clause.body, streams)
+	case clause.elseBody != nil:
+		return execute(clause.elseBody, streams)
+	}
+	return 0
+}
+
+func executeLoop(loop *LoopClause, streams *Streams) int {
+	loopLevel++
+	defer func() { loopLevel-- }()
+
+	status := 0
+	for {
+		condition := executeCondition(loop.condition, streams)
+		if pendingFlow != flowNone {
+			if loopDone() {
+				break
+			}
+			continue
+		}
+		if (condition == 0) == loop.until {
+			break
+		}
+
+		status = execute(loop.body, streams)
+		if loopDone() {
+			break
+		}
+	}
+	return status
+}
+
+func executeFor(loop *ForClause, streams *Streams) int {
+	values, err := expandWords(loop.words)
+	if err != nil {
+		return expansionFailed(err, streams)
+	}
+
+	loopLevel++
+	defer func() { loopLevel-- }()
+
+	status := 0
+	for _, value := range values {
+		setVar(loop.name, value)
+		status = execute(loop.body, streams)
+		if loopDone() {
+			break
+		}
+	}
+	return status
+}
+
+// loopDone handles a pending `break` or `continue` at the end of a loop
+// iteration and reports whether the loop has to stop. Flow that is meant for
+// an outer loop, or for something else like `exit`, is left pending.
+func loopDone() bool {
+	switch pendingFlow {
+	case flowNone:
+		return false
+	case flowBreak, flowContinue:
+		flowLevels--
+		if flowLevels > 0 {
+			return true
+		}
+		done := pendingFlow == flowBreak
+		pendingFlow = flowNone
+		return done
+	}
+	return true
+}
+
+func executeCase(clause *CaseClause, streams *Streams) int {
+	word, err := expandString(clause.word.parts)
+	if err != nil {
+		return expansionFailed(err, streams)
+	}
+
+	for _, item := range clause.items {
+		for _, pattern := range item.patterns {
+			expanded, err := expandPattern(pattern.parts)
+			if err != nil {
+				return expansionFailed(err, streams)
+			}
+			if !MatchPattern(expanded, word) {
+				continue
+			}
+			if item.body == nil {
+				return 0
+			}
+			return execute(item.body, streams)
+		}
+	}
+	return 0
+}
+
+func negate(status int) int {
+	if status == 0 {
+		return 1
 	}
+	return 0
+}
+
+// executePipeline runs the commands of a pipeline concurrently and returns
+// the exit status of the last one.
+func executePipeline(nodes []SyntaxNode, streams *Streams) int {
 
 	var executables []Executable
 	resourceManager := &ResourceManager{}
 
+	// with job control, the external commands of a pipeline run by the shell
+	// itself, rather than by one of its subshells, get a process group of
+	// their own which has the terminal while they run
+	jobControlled := jobControl && subshellLevel == 0
+
+	// the pipes are set up first, so that the redirections of each command
+	// apply on top of them, as in `cmd 2>&1 | less`
+	stages := make([]Streams, len(nodes))
+	pipeEnds := make([][]io.Closer, len(nodes))
+	for i := range nodes {
+		stages[i] = *streams
+	}
+	for i := range len(nodes) - 1 {
+		r, w, _ := os.Pipe()
+		// Current Command Will Write at the Pipe's Write end
+		stages[i].Stdout = w
+		pipeEnds[i] = append(pipeEnds[i], w)
+		// Next Command Will Read from the Pipe's Read end
+		stages[i+1].Stdin = r
+		pipeEnds[i+1] = append(pipeEnds[i+1], r)
+	}
+
 	defer func() {
 		resourceManager.CloseResources()
 	}()
 
-	for _, command := range commands {
-		executable, err := CreateExecutable(command, resourceManager)
+	for i, node := range nodes {
+		// the shell code of a pipeline runs inside the shell, changing its
+		// state, only in the last command; the commands before run at the
+		// same time as it, in new gosh processes of their own
+		last := i == len(nodes)-1
+		command, ok := node.(*Command)
+		if !ok && !last {
+			executable, err := NewShellProcess(node.String(), positionalParams)
+			if err == nil {
+				err = SetIO(nil, executable, &stages[i], resourceManager)
+			}
+			if err != nil {
+				fmt.Fprintf(streams.Stderr, "%s: %v\n", shellName, err)
+				closeStages(pipeEnds)
+				return 1
+			}
+			addClosers(executable, pipeEnds[i])
+			executables = append(executables, executable)
+			continue
+		}
+		if !ok {
+			executables = append(executables, NewNodeCommand(node, &stages[i]))
+			addClosers(executables[len(executables)-1], pipeEnds[i])
+			continue
+		}
+
+		substitutionStatus = 0
+		command, err := command.Expand()
 		if err != nil {
-			fmt.Println(err)
-			return
+			closeStages(pipeEnds)
+			if len(nodes) > 1 {
+				// the failing command is only one stage of the pipeline
+				fmt.Fprintf(streams.Stderr, "%s: %v\n", shellName, err)
+				return 1
+			}
+			return expansionFailed(err, streams)
+		}
+
+		// a command made only of assignments sets shell variables
+		if command.name == "" {
+			if len(nodes) == 1 {
+				applyAssignments(command.env)
+				return substitutionStatus
+			}
+			closeAll(pipeEnds[i])
+			continue
+		}
+
+		var executable Executable
+		if _, isFunction := functions[command.name]; isFunction && !last {
+			executable, err = newFunctionProcess(command, resourceManager, &stages[i])
+		} else {
+			executable, err = CreateExecutable(command, resourceManager, &stages[i])
 		}
+		if errors.Is(err, errNotFound) {
+			fmt.Fprintln(streams.Stderr, err)
+			closeStages(pipeEnds)
+			return 127
+		} else if err != nil {
+			fmt.Fprintf(streams.Stderr, "%s: %v\n", shellName, err)
+			closeStages(pipeEnds)
+			return 1
+		}
+		addClosers(executable, pipeEnds[i])
 		executables = append(executables, executable)
 	}
 
-	pipeCount := len(executables) - 1
-	var openFiles []*os.File
+	// like subshells, the commands of a pipeline cannot exit the shell
+	if len(nodes) > 1 {
+		subshellLevel++
+		defer func() {
+			subshellLevel--
+			if pendingFlow != flowInterrupt {
+				pendingFlow = flowNone
+			}
+		}()
+	}
 
-	for i := range pipeCount {
-		r, w, _ := os.Pipe()
-		// Current Command Will Write at the Pipe's Write end
-		executables[i].SetStdout(w)
-		// Next Command Will Read from the Pipe's Read end
-		executables[i+1].SetStdin(r)
+	pgid := 0
+	startErrors := make([]error, len(executables))
+	for i, e := range executables {
+		external, isExternal := e.(*ExternalCommand)
+		if isExternal && jobControlled {
+			external.cmd.SysProcAttr = &syscall.SysProcAttr{
+				Setpgid:    true,
+				Pgid:       pgid,
+				Foreground: pgid == 0,
+				Ctty:       terminalFd,
+			}
+		}
+		if err := e.Start(); err != nil {
+			fmt.Fprintf(streams.Stderr, "%s: %v\n", shellName, err)
+			startErrors[i] = err
+		} else if isExternal && jobControlled && pgid == 0 {
+			pgid = external.cmd.Process.Pid
+		}
+	}
 
-		if executables[i].GetCommandType() == "EXTERNAL" {
-			openFiles = append(openFiles, w)
+	if pgid != 0 {
+		commands := make([]string, len(nodes))
+		for i, node := range nodes {
+			commands[i] = node.String()
 		}
+		return waitForeground(newJob(strings.Join(commands, " | "), pgid, executables, startErrors))
+	}
 
-		if executables[i+1].GetCommandType() == "EXTERNAL" {
-			openFiles = append(openFiles, r)
+	var err error
+	for i, e := range executables {
+		err = startErrors[i]
+		if err == nil {
+			err = e.Wait()
 		}
+	}
+	reportSignal(streams.Stderr, err)
+	return exitStatusOf(err)
+}
 
+// newFunctionProcess returns a command calling the function command names
+// in a new gosh process.
+func newFunctionProcess(command *Command, r *ResourceManager, streams *Streams) (Executable, error) {
+	process, err := NewShellProcess(quoteWord(command.name)+` "$@"`, command.args)
+	if err != nil {
+		return nil, err
 	}
+	if len(command.env) > 0 {
+		process.cmd.Env = append(os.Environ(), command.env...)
+	}
+	if err := SetIO(command.redirections, process, streams, r); err != nil {
+		return nil, err
+	}
+	return process, nil
+}
 
-	PerformTask(executables, func(e Executable) {
-		e.Start()
-	})
+func addClosers(executable Executable, closers []io.Closer) {
+	for _, c := range closers {
+		executable.AddCloser(c)
+	}
+}
 
-	Do(openFiles, func(file *os.File) {
-		file.Close()
-	})
+// closeStages closes the pipes of a pipeline that does not run.
+func closeStages(pipeEnds [][]io.Closer) {
+	for _, closers := range pipeEnds {
+		closeAll(closers)
+	}
+}
 
-	PerformTask(executables, func(e Executable) {
-		e.Wait()
-	})
+func applyAssignments(env []string) {
+	for _, assignment := range env {
+		name, value, _ := strings.Cut(assignment, "=")
+		setVar(name, value)
+	}
+}
+
+// applyTemporaryAssignments sets the variables of the assignments made
+// before the name of a function or builtin, as in `LANG=C cmd`, and returns
+// a function giving them back the values they had.
+func applyTemporaryAssignments(env []string) func() {
+	saved := make(map[string]savedVar, len(env))
+	for _, assignment := range env {
+		name, value, _ := strings.Cut(assignment, "=")
+		if _, ok := saved[name]; !ok {
+			previous, set := os.LookupEnv(name)
+			saved[name] = savedVar{value: previous, set: set}
+		}
+		setVar(name, value)
+	}
+
+	return func() {
+		for name, variable := range saved {
+			if variable.set {
+				setVar(name, variable.value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+// ExitStatus is returned by builtins that need to report a specific exit
+// status rather than the generic failure status 1.
+type ExitStatus int
+
+func (e ExitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// exitStatusOf converts the error returned by Executable.Wait into an exit
+// status.
+func exitStatusOf(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var status ExitStatus
+	if errors.As(err, &status) {
+		return int(status)
+	}
+
+	if sig, ok := signalOf(err); ok {
+		return 128 + int(sig)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	return 1
 }
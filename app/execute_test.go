@@ -0,0 +1,477 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{`true`, 0},
+		{`false`, 1},
+		{`false && true`, 1},
+		{`false || true`, 0},
+		{`true && false || true`, 0},
+		{`false; true`, 0},
+		{`no-such-command-gosh`, 127},
+		{`sh -c 'exit 3'`, 3},
+		{`true | false`, 1},
+		{`sh -c 'kill -TERM $$'`, 143},
+		{`sh -c 'kill -PIPE $$'`, 141},
+		{`x=1`, 0},
+		{`x=$(false)`, 1},
+		{`x=$(sh -c 'exit 5')`, 5},
+		{`x=$(false) y=$(true)`, 0},
+		{`false; x=1`, 0},
+	}
+
+	for _, tt := range tests {
+		if got := ExecuteCommand(tt.input); got != tt.expected {
+			t.Errorf("ExecuteCommand(%q) = %d, expected: %d", tt.input, got, tt.expected)
+		}
+	}
+
+	ExecuteCommand(`sh -c 'exit 4'`)
+	if status, _ := lookupVar("?"); status != "4" {
+		t.Errorf("$? = %q, expected: %q", status, "4")
+	}
+}
+
+func TestExecutePaths(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "run"), []byte("#!/bin/sh\necho ran $1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"./run a", "ran a"},
+		{"sub/../run b", "ran b"},
+		{filepath.Join(dir, "run") + " c", "ran c"},
+		{"true && ./run d", "ran d"},
+		{"./sub 2>/dev/null; echo $?", "127"},
+		{"./missing 2>/dev/null; echo $?", "127"},
+	}
+
+	for _, tt := range tests {
+		if got := CommandSubstitution(tt.input); got != tt.expected {
+			t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestExecuteInterrupted(t *testing.T) {
+
+	interrupted.Store(true)
+	if got := CommandSubstitution("echo a; echo b"); got != "" {
+		t.Errorf("an interrupted command line printed %q", got)
+	}
+	if got := ExecuteCommand("true"); got != 130 {
+		t.Errorf("an interrupted command line returned %d, expected: 130", got)
+	}
+	if got := ExecuteCommand("true"); got != 0 {
+		t.Errorf("the command line after an interrupt returned %d, expected: 0", got)
+	}
+}
+
+func TestExecuteCompoundCommands(t *testing.T) {
+
+	t.Setenv("GROUPED", "outer")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Brace Group Shares State",
+			input:    `{ GROUPED=changed; }; echo $GROUPED`,
+			expected: "changed\n",
+		},
+		{
+			name:     "Subshell Keeps Its State",
+			input:    `(GROUPED=inner; cd /; echo $GROUPED); echo $GROUPED`,
+			expected: "inner\nchanged\n",
+		},
+		{
+			name:     "Exit Leaves Only The Subshell",
+			input:    `(echo in; exit 4; echo never); echo $?`,
+			expected: "in\n4\n",
+		},
+		{
+			name:     "Compound Commands In A Pipeline",
+			input:    `{ echo b; echo a; } | sort | { cat; echo done; }`,
+			expected: "a\nb\ndone\n",
+		},
+		{
+			name:     "If",
+			input:    `if false; then echo a; elif true; then echo b; else echo c; fi; if false; then echo d; fi; echo $?`,
+			expected: "b\n0\n",
+		},
+		{
+			name:     "While And Until",
+			input:    `GROUPED=; while test "$GROUPED" != xxx; do GROUPED=x$GROUPED; done; until true; do echo never; done; echo $GROUPED`,
+			expected: "xxx\n",
+		},
+		{
+			name:     "Break And Continue",
+			input:    `for i in 1 2 3; do for j in a b c; do if test $j = b; then continue 2; fi; if test $i = 3; then break 2; fi; echo $i$j; done; done`,
+			expected: "1a\n2a\n",
+		},
+		{
+			name:     "Case",
+			input:    `for f in main.go x.c '*'; do case $f in *.go) echo go;; "*") echo star;; *) echo other;; esac; done`,
+			expected: "go\nother\nstar\n",
+		},
+		{
+			name:     "Negation",
+			input:    `! true; echo $?; ! false && echo yes`,
+			expected: "1\nyes\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CommandSubstitution(tt.input) + "\n"; got != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecuteFunctions(t *testing.T) {
+
+	t.Setenv("SCOPED", "global")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Positional Parameters",
+			input:    `show() { echo "$# $1 [$*]"; for arg in "$@"; do echo "<$arg>"; done; }; show "a b" c`,
+			expected: "2 a b [a b c]\n<a b>\n<c>\n",
+		},
+		{
+			name:     "Local Variables",
+			input:    `inner() { echo $SCOPED; }; outer() { local SCOPED=local; inner; }; outer; echo $SCOPED`,
+			expected: "local\nglobal\n",
+		},
+		{
+			name:     "Return",
+			input:    `check() { for i in 1 2 3; do if test $i = 2; then return 5; fi; echo $i; done; }; check; echo $?`,
+			expected: "1\n5\n",
+		},
+		{
+			name:     "Function In A Pipeline",
+			input:    `upper() { tr a-z A-Z; }; echo shout | upper`,
+			expected: "SHOUT\n",
+		},
+		{
+			name:     "Assignments Before A Call",
+			input:    `show() { echo "$SCOPED $GOSH_NEW"; }; SCOPED=call GOSH_NEW=new show; echo "$SCOPED ${GOSH_NEW:-unset}"; GOSH_NEW=piped show | cat`,
+			expected: "call new\nglobal unset\nglobal piped\n",
+		},
+		{
+			name:     "Assignments Before A Builtin",
+			input:    `GOSH_NEW=1 compgen -v GOSH_N; echo "${GOSH_NEW:-unset}"`,
+			expected: "GOSH_NEW\nunset\n",
+		},
+		{
+			name:     "Functions On Both Sides Of A Pipeline",
+			input:    `f() { local n=$1; echo $n; cat; }; g() { f 3 | f 1; echo "$1 $n"; }; g top`,
+			expected: "1\n3\ntop \n",
+		},
+		{
+			name:     "Type",
+			input:    `greet() { echo hi; }; type greet`,
+			expected: "greet is a function\ngreet() { echo hi; }\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CommandSubstitution(tt.input) + "\n"; got != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecuteHereDocuments(t *testing.T) {
+
+	t.Setenv("NAME", "gosh")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Expanded Body",
+			input:    "cat <<EOF\nhi $NAME $(echo sub)\n\\$NAME \"q\" \\\\\nEOF",
+			expected: "hi gosh sub\n$NAME \"q\" \\\n",
+		},
+		{
+			name:     "Quoted Delimiter",
+			input:    "cat <<'EOF'\n$NAME `echo x` \\$\nEOF",
+			expected: "$NAME `echo x` \\$\n",
+		},
+		{
+			name:     "Tab Stripping",
+			input:    "cat <<-EOF\n\t\tindented\n\tEOF",
+			expected: "indented\n",
+		},
+		{
+			name:     "Several On One Line",
+			input:    "cat <<A; cat <<B\nfirst\nA\nsecond\nB",
+			expected: "first\nsecond\n",
+		},
+		{
+			name:     "Here-String",
+			input:    `tr a-z A-Z <<<"$NAME rocks"`,
+			expected: "GOSH ROCKS\n",
+		},
+		{
+			name:     "Compound Command",
+			input:    "{ cat; echo end; } <<EOF\nbody\nEOF",
+			expected: "body\nend\n",
+		},
+		{
+			name:     "Descriptor Number",
+			input:    "cat <<A | cat - /dev/fd/3 3<<-B\none\nA\n\ttwo\n\tB",
+			expected: "one\ntwo\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CommandSubstitution(tt.input) + "\n"; got != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecuteRedirections(t *testing.T) {
+
+	t.Chdir(t.TempDir())
+	defer func() { shellOptions["noclobber"] = false }()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Both Outputs To A File",
+			input:    "ls /nonexistent >log 2>&1; cat log | wc -l",
+			expected: "1",
+		},
+		{
+			name:     "Duplication Order",
+			input:    "ls /nonexistent 2>&1 >log | wc -l; cat log",
+			expected: "1",
+		},
+		{
+			name:     "Standard Error Through A Pipe",
+			input:    "{ echo out; echo err >&2; } 2>&1 | sort",
+			expected: "err\nout",
+		},
+		{
+			name:     "Ampersand Redirection",
+			input:    "echo a &>all; ls /nonexistent &>>all; wc -l <all",
+			expected: "2",
+		},
+		{
+			name:     "Extra Descriptor",
+			input:    "{ echo three >&3; echo out; } 3>fd3; cat fd3",
+			expected: "out\nthree",
+		},
+		{
+			name:     "Extra Descriptor For External Command",
+			input:    "sh -c 'echo ext >&4' 4>fd4; cat 5<fd4 <&5",
+			expected: "ext",
+		},
+		{
+			name:     "Read Write",
+			input:    "echo rw 1<>rw; cat rw",
+			expected: "rw",
+		},
+		{
+			name:     "Closed Descriptor",
+			input:    "echo lost >&- 2>/dev/null; echo $?",
+			expected: "1",
+		},
+		{
+			name:     "Bad Descriptor",
+			input:    "{ echo x >&7; } 2>/dev/null; echo $?",
+			expected: "1",
+		},
+		{
+			name:     "Noclobber",
+			input:    "echo old >kept; set -C; { echo new >kept; } 2>/dev/null; echo $?; cat kept; echo forced >|kept; cat kept; set +C",
+			expected: "1\nold\nforced",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CommandSubstitution(tt.input); got != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecuteBackgroundJobs(t *testing.T) {
+
+	defer delete(functions, "greet")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Wait For Pid",
+			input:    "{ echo bg; exit 3; } & wait $!; echo $?",
+			expected: "bg\n3",
+		},
+		{
+			name:     "Wait For All",
+			input:    "echo a | tr a b & sleep 0.1 & wait; echo $?",
+			expected: "b\n0",
+		},
+		{
+			name:     "Runs In A Subshell",
+			input:    "dir=$(pwd); cd / & x=1 & wait; [ \"$(pwd)\" = \"$dir\" ] && echo same $x",
+			expected: "same",
+		},
+		{
+			name:     "Functions And Arguments",
+			input:    "set -- one; f() { echo \"f $1\"; }; f \"$1\" & wait",
+			expected: "f one",
+		},
+		{
+			name:     "Here-Document Function",
+			input:    "greet() { cat <<EOF\nhi $1 \"q\" \\$x $(echo sub)\nEOF\n}\necho ok & wait; greet a & wait",
+			expected: "ok\nhi a \"q\" $x sub",
+		},
+		{
+			name:     "Here-Documents In The Background",
+			input:    "cat <<'EOF' &\nraw $x\nEOF\nwait; cat <<EOF | tr a b &\n\nEOF\nwait; echo $?",
+			expected: "raw $x\n\n0",
+		},
+		{
+			name:     "Pid Of The Program",
+			input:    "greet() { :; }; set -C; sleep 5 & ps -o comm= -p $! | sed 's|.*/||'; kill $!; wait $!; echo $?; set +C",
+			expected: "sleep\n143",
+		},
+		{
+			name:     "Jobs",
+			input:    "sleep 0.1 & jobs; wait; jobs",
+			expected: "[1]+  Running                 sleep 0.1 &",
+		},
+		{
+			name:     "Unknown Job",
+			input:    "wait %9 2>/dev/null; echo $?",
+			expected: "127",
+		},
+		{
+			name:     "No Job Control",
+			input:    "fg 2>/dev/null; echo $?",
+			expected: "1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CommandSubstitution(tt.input); got != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecuteTraps(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Err",
+			input:    "trap 'log=\"$log err$?\"' ERR; false; if false; then :; fi; false || true; ! false; echo $log",
+			expected: "err1",
+		},
+		{
+			name:     "Err After Function Call",
+			input:    "trap 'log=\"$log err\"' ERR; f() { false; false; }; f; echo $log",
+			expected: "err",
+		},
+		{
+			name:     "Return",
+			input:    "trap 'log=\"$log ret$?\"' RETURN; f() { log=f; return 2; }; f; echo $log",
+			expected: "f ret2",
+		},
+		{
+			name:     "Debug",
+			input:    "trap 'log=\"$log d\"' DEBUG; x=1; echo $log",
+			expected: "d d",
+		},
+		{
+			name:     "Signal",
+			input:    "trap 'log=usr1' USR1; kill -USR1 $$; sleep 0.1; echo $log",
+			expected: "usr1",
+		},
+		{
+			name:     "Ignored Signal",
+			input:    "trap '' USR2; kill -USR2 $$; sleep 0.1; echo alive",
+			expected: "alive",
+		},
+		{
+			name:     "Print",
+			input:    "trap 'echo it'\\''s' USR1; trap ':' 0; trap -p",
+			expected: "trap -- ':' EXIT\ntrap -- 'echo it'\\''s' USR1",
+		},
+		{
+			name:     "Reset",
+			input:    "trap : USR1 USR2; trap - USR1; trap USR2; trap",
+			expected: "",
+		},
+		{
+			name:     "Invalid Signal",
+			input:    "trap : NOPE 2>/dev/null; echo $?",
+			expected: "1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				for name := range traps {
+					resetTrap(name)
+				}
+				setVar("log", "")
+			}()
+			if got := CommandSubstitution(tt.input); got != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
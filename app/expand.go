@@ -0,0 +1,541 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const defaultIFS = " \t\n"
+
+// Expand resolves the words, assignments and redirection targets of a parsed
+// command into a command that is ready to run.
+func (c *Command) Expand() (*Command, error) {
+
+	fields, err := expandWords(c.words)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	for _, assignment := range c.assignments {
+		name, parts := splitAssignment(assignment)
+		value, err := expandString(expandTilde(parts, true))
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, name+"="+value)
+	}
+
+	redirections, err := expandRedirections(c.redirections)
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := &Command{pos: c.pos, env: env, redirections: redirections}
+	if len(fields) > 0 {
+		expanded.name = fields[0]
+		expanded.args = fields[1:]
+	}
+	return expanded, nil
+}
+
+// expandRedirections expands redirection targets into file names.
+func expandRedirections(redirections []*Redirection) ([]*Redirection, error) {
+	var expanded []*Redirection
+	for _, redirection := range redirections {
+		expandedRedirection := &Redirection{fd: redirection.fd, op: redirection.op, appendOnly: redirection.appendOnly}
+		var err error
+		switch redirection.op {
+		case "<<", "<<-":
+			expandedRedirection.isInput = true
+			expandedRedirection.input, err = expandString(redirection.hereDoc)
+		case "<<<":
+			expandedRedirection.isInput = true
+			expandedRedirection.input, err = expandString(expandTilde(redirection.target.parts, false))
+			expandedRedirection.input += "\n"
+		default:
+			expandedRedirection.fileName, err = expandString(expandTilde(redirection.target.parts, false))
+		}
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, expandedRedirection)
+	}
+	return expanded, nil
+}
+
+// expandWords brace expands words and then expands each resulting word into
+// fields.
+func expandWords(words []*Token) ([]string, error) {
+	var fields []string
+	for _, word := range words {
+		for _, parts := range expandBraces(word.parts) {
+			expanded, err := expandWord(expandTilde(parts, false))
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, expanded...)
+		}
+	}
+	return fields, nil
+}
+
+// expandTilde replaces a `~` prefix at the start of a word with the home
+// directory it names. In assignment values, a `~` following a `:` is
+// expanded as well, as in `PATH=~/bin:~/go/bin`. The prefix runs up to the
+// next `/` and has to be unquoted for the expansion to happen.
+func expandTilde(parts []wordPart, assignment bool) []wordPart {
+	terminators := "/"
+	if assignment {
+		terminators = "/:"
+	}
+
+	var expanded []wordPart
+	for i, part := range parts {
+		if part.kind != literalPart || part.quoted || (i > 0 && !assignment) {
+			expanded = append(expanded, part)
+			continue
+		}
+
+		text := part.value
+		var literal strings.Builder
+		for pos := 0; pos < len(text); {
+			atStart := (pos == 0 && i == 0) || (assignment && pos > 0 && text[pos-1] == ':')
+			if atStart && text[pos] == '~' {
+				end := strings.IndexAny(text[pos:], terminators)
+				switch {
+				case end >= 0:
+					end += pos
+				case i == len(parts)-1:
+					end = len(text)
+				}
+				// a prefix running into a quoted or expanded part stays as it is
+				if end >= 0 {
+					if home, ok := tildeDirectory(text[pos+1 : end]); ok {
+						if literal.Len() > 0 {
+							expanded = append(expanded, wordPart{kind: literalPart, value: literal.String()})
+							literal.Reset()
+						}
+						expanded = append(expanded, wordPart{kind: literalPart, value: home, quoted: true})
+						pos = end
+						continue
+					}
+				}
+			}
+			literal.WriteByte(text[pos])
+			pos++
+		}
+		if literal.Len() > 0 {
+			expanded = append(expanded, wordPart{kind: literalPart, value: literal.String()})
+		}
+	}
+	return expanded
+}
+
+// tildeDirectory returns the directory for the tilde prefix `~name`: the home
+// directory of the user or, for an empty name, of the current user. `~+` and
+// `~-` are the current and the previous working directory.
+func tildeDirectory(name string) (string, bool) {
+	switch name {
+	case "":
+		if home, ok := lookupVar("HOME"); ok {
+			return home, true
+		}
+		current, err := user.Current()
+		if err != nil {
+			return "", false
+		}
+		return current.HomeDir, true
+	case "+":
+		if pwd, ok := lookupVar("PWD"); ok {
+			return pwd, true
+		}
+		pwd, err := os.Getwd()
+		return pwd, err == nil
+	case "-":
+		return lookupVar("OLDPWD")
+	}
+
+	account, err := user.Lookup(name)
+	if err != nil {
+		return "", false
+	}
+	return account.HomeDir, true
+}
+
+// expandWord expands the parameters and command substitutions in a word,
+// splits unquoted results on IFS and expands the resulting pathname patterns,
+// so one word can produce zero or more fields.
+func expandWord(parts []wordPart) ([]string, error) {
+	var fields []string
+	// pattern is the current field with its quoted characters escaped, which
+	// keeps them literal during pathname expansion
+	var current, pattern strings.Builder
+	inField := false
+	ifs := fieldSeparators()
+
+	write := func(s string, quoted bool) {
+		current.WriteString(s)
+		if quoted {
+			s = escapePattern(s)
+		}
+		pattern.WriteString(s)
+	}
+
+	endField := func() error {
+		matches, err := expandPathname(current.String(), pattern.String())
+		if err != nil {
+			return err
+		}
+		fields = append(fields, matches...)
+		current.Reset()
+		pattern.Reset()
+		inField = false
+		return nil
+	}
+
+	for _, part := range parts {
+		switch part.kind {
+		case literalPart:
+			write(part.value, part.quoted)
+			inField = inField || part.quoted || part.value != ""
+		case paramPart, commandPart:
+			if part.quoted && (part.value == "@" || part.value == "{@}") {
+				// "$@" keeps every positional parameter a separate field
+				for i, param := range positionalParams {
+					if i > 0 {
+						if err := endField(); err != nil {
+							return nil, err
+						}
+					}
+					write(param, true)
+					inField = true
+				}
+				continue
+			}
+			values, err := expandPartText(part)
+			if err != nil {
+				return nil, err
+			}
+			if part.quoted {
+				write(joinParts(values), true)
+				inField = true
+				continue
+			}
+			for _, value := range values {
+				if value.quoted {
+					write(value.value, true)
+					inField = true
+					continue
+				}
+				for _, r := range value.value {
+					if strings.ContainsRune(ifs, r) {
+						if inField {
+							if err := endField(); err != nil {
+								return nil, err
+							}
+						}
+						continue
+					}
+					write(string(r), false)
+					inField = true
+				}
+			}
+		}
+	}
+
+	if inField {
+		if err := endField(); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+// expandPathname returns the files matching pattern, or the field itself when
+// it is not a pattern or, without nullglob and failglob, matches nothing.
+func expandPathname(field string, pattern string) ([]string, error) {
+	if !hasGlobMeta(pattern) {
+		return []string{field}, nil
+	}
+
+	matches := glob(pattern)
+	switch {
+	case len(matches) > 0:
+		return matches, nil
+	case globOptions["failglob"]:
+		return nil, fmt.Errorf("no match: %s", field)
+	case globOptions["nullglob"]:
+		return nil, nil
+	}
+	return []string{field}, nil
+}
+
+// expandString expands a word without field splitting, as done for
+// assignments and redirection targets.
+func expandString(parts []wordPart) (string, error) {
+	var result strings.Builder
+	for _, part := range parts {
+		switch part.kind {
+		case literalPart:
+			result.WriteString(part.value)
+		case paramPart, commandPart:
+			value, err := expandPart(part)
+			if err != nil {
+				return "", err
+			}
+			result.WriteString(value)
+		}
+	}
+	return result.String(), nil
+}
+
+// expandPattern expands a word used as a pattern, escaping the characters
+// that were quoted so they only match themselves.
+func expandPattern(parts []wordPart) (string, error) {
+	var result strings.Builder
+	for _, part := range parts {
+		value := part.value
+		if part.kind != literalPart {
+			var err error
+			if value, err = expandPart(part); err != nil {
+				return "", err
+			}
+		}
+		if part.quoted {
+			value = escapePattern(value)
+		}
+		result.WriteString(value)
+	}
+	return result.String(), nil
+}
+
+func escapePattern(s string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+func expandPart(part wordPart) (string, error) {
+	values, err := expandPartText(part)
+	if err != nil {
+		return "", err
+	}
+	return joinParts(values), nil
+}
+
+// expandPartText expands a parameter or command part into literal parts, as
+// the word of `${VAR:-word}` keeps its own quoting.
+func expandPartText(part wordPart) ([]wordPart, error) {
+	if part.kind == commandPart {
+		return []wordPart{{kind: literalPart, value: CommandSubstitution(part.value)}}, nil
+	}
+	return expandParamParts(part.value)
+}
+
+// expandText expands the word of a `${VAR:-word}` style expansion.
+func expandText(s string) (string, error) {
+	parts, err := expandTextParts(s)
+	if err != nil {
+		return "", err
+	}
+	return joinParts(parts), nil
+}
+
+// expandTextParts expands the word of a `${VAR:-word}` style expansion into
+// literal parts that keep whether they were quoted.
+func expandTextParts(s string) ([]wordPart, error) {
+	parts, err := parseWord(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var expanded []wordPart
+	for _, part := range parts {
+		switch part.kind {
+		case literalPart:
+			expanded = append(expanded, part)
+		case paramPart, commandPart:
+			values, err := expandPartText(part)
+			if err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				value.quoted = value.quoted || part.quoted
+				expanded = append(expanded, value)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+func joinParts(parts []wordPart) string {
+	var result strings.Builder
+	for _, part := range parts {
+		result.WriteString(part.value)
+	}
+	return result.String()
+}
+
+func fieldSeparators() string {
+	if ifs, ok := lookupVar("IFS"); ok {
+		return ifs
+	}
+	return defaultIFS
+}
+
+// expandParam expands the raw text of a parameter as kept by the tokenizer:
+// either a bare name (`HOME`, `?`) or a braced expression (`{HOME:-/}`).
+func expandParam(raw string) (string, error) {
+	parts, err := expandParamParts(raw)
+	if err != nil {
+		return "", err
+	}
+	return joinParts(parts), nil
+}
+
+// expandParamParts expands a parameter into literal parts. The value of a
+// parameter is one unquoted part, while a default or alternate word keeps
+// the quoting it was written with, so that only its unquoted text is split.
+func expandParamParts(raw string) ([]wordPart, error) {
+	text := func(value string) []wordPart {
+		return []wordPart{{kind: literalPart, value: value}}
+	}
+
+	if !strings.HasPrefix(raw, "{") {
+		value, _ := lookupVar(raw)
+		return text(value), nil
+	}
+
+	body := strings.TrimSuffix(strings.TrimPrefix(raw, "{"), "}")
+
+	// ${#VAR}
+	if len(body) > 1 && body[0] == '#' {
+		if name, op, _ := splitParam(body[1:]); name != "" && op == "" {
+			value, _ := lookupVar(name)
+			return text(strconv.Itoa(len([]rune(value)))), nil
+		}
+	}
+
+	name, op, word := splitParam(body)
+	if name == "" || (op == "" && word != "") {
+		return nil, fmt.Errorf("${%s}: bad substitution", body)
+	}
+
+	value, set := lookupVar(name)
+	empty := !set || (strings.HasPrefix(op, ":") && value == "")
+
+	switch op {
+	case "":
+		return text(value), nil
+	case "-", ":-":
+		if empty {
+			return expandTextParts(word)
+		}
+		return text(value), nil
+	case "=", ":=":
+		if !empty {
+			return text(value), nil
+		}
+		if !isValidName(name) {
+			return nil, fmt.Errorf("$%s: cannot assign in this way", name)
+		}
+		parts, err := expandTextParts(word)
+		if err != nil {
+			return nil, err
+		}
+		return parts, setVar(name, joinParts(parts))
+	case "?", ":?":
+		if !empty {
+			return text(value), nil
+		}
+		message, err := expandText(word)
+		if err != nil {
+			return nil, err
+		}
+		if message == "" {
+			message = "parameter null or not set"
+		}
+		return nil, fmt.Errorf("%s: %s", name, message)
+	case "+", ":+":
+		if empty {
+			return nil, nil
+		}
+		return expandTextParts(word)
+	default:
+		pattern, err := expandText(word)
+		if err != nil {
+			return nil, err
+		}
+		return text(trimPattern(value, pattern, op)), nil
+	}
+}
+
+// splitParam splits the body of a braced expansion into the parameter name,
+// the operator and the word following it.
+func splitParam(body string) (string, string, string) {
+	end := 0
+	switch {
+	case body == "":
+		return "", "", ""
+	case isNameStart(rune(body[0])):
+		for end < len(body) && isNameRune(rune(body[end])) {
+			end++
+		}
+	case body[0] >= '0' && body[0] <= '9':
+		for end < len(body) && body[end] >= '0' && body[end] <= '9' {
+			end++
+		}
+	case strings.ContainsRune(specialParams, rune(body[0])):
+		end = 1
+	}
+
+	name, rest := body[:end], body[end:]
+	for _, op := range []string{":-", ":=", ":?", ":+", "##", "%%", "-", "=", "?", "+", "#", "%"} {
+		if strings.HasPrefix(rest, op) {
+			return name, op, rest[len(op):]
+		}
+	}
+	return name, "", rest
+}
+
+// trimPattern implements the `#`, `##`, `%` and `%%` prefix and suffix
+// removal operators.
+func trimPattern(value string, pattern string, op string) string {
+	runes := []rune(value)
+	switch op {
+	case "#":
+		for i := 0; i <= len(runes); i++ {
+			if MatchPattern(pattern, string(runes[:i])) {
+				return string(runes[i:])
+			}
+		}
+	case "##":
+		for i := len(runes); i >= 0; i-- {
+			if MatchPattern(pattern, string(runes[:i])) {
+				return string(runes[i:])
+			}
+		}
+	case "%":
+		for i := len(runes); i >= 0; i-- {
+			if MatchPattern(pattern, string(runes[i:])) {
+				return string(runes[:i])
+			}
+		}
+	case "%%":
+		for i := 0; i <= len(runes); i++ {
+			if MatchPattern(pattern, string(runes[i:])) {
+				return string(runes[:i])
+			}
+		}
+	}
+	return value
+}
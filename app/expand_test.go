@@ -0,0 +1,311 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// parseCommand returns the first command of input.
+func parseCommand(t *testing.T, input string) *Command {
+	t.Helper()
+	node, err := Parse(input)
+	if err != nil {
+		t.Fatalf("Parse(%q) returned error: %v", input, err)
+	}
+	command, ok := node.(*Command)
+	if !ok {
+		t.Fatalf("Parse(%q) = %T, expected: *Command", input, node)
+	}
+	return command
+}
+
+func TestExpandParameters(t *testing.T) {
+
+	t.Setenv("NAME", "gosh")
+	t.Setenv("EMPTY", "")
+	t.Setenv("FILE", "main.go")
+	t.Setenv("FILEPATH", "/usr/local/bin/gosh.tar.gz")
+	t.Setenv("WORDS", "a  b c")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			name:     "Simple Variable",
+			input:    `echo $NAME ${NAME}`,
+			expected: []string{"gosh", "gosh"},
+		},
+		{
+			name:     "Single Quotes Suppress Expansion",
+			input:    `echo '$NAME' "$NAME" \$NAME`,
+			expected: []string{"$NAME", "gosh", "$NAME"},
+		},
+		{
+			name:     "Word Splitting",
+			input:    `echo $WORDS "$WORDS"`,
+			expected: []string{"a", "b", "c", "a  b c"},
+		},
+		{
+			name:     "Empty Unquoted Variable Is Removed",
+			input:    `echo $EMPTY "$EMPTY" $UNSET_VARIABLE`,
+			expected: []string{""},
+		},
+		{
+			name:     "Default Values",
+			input:    `echo ${UNSET_VARIABLE:-fallback} ${EMPTY:-empty} ${EMPTY-set} "${UNSET_VARIABLE:-$NAME rc}"`,
+			expected: []string{"fallback", "empty", "gosh rc"},
+		},
+		{
+			name:     "Default Values Keep Their Quoting",
+			input:    `echo ${UNSET_VARIABLE:-"a  b"} ${UNSET_VARIABLE-x"$WORDS"y} ${NAME:+'1  2' 3} ${UNSET_VARIABLE:-$WORDS}`,
+			expected: []string{"a  b", "xa  b cy", "1  2", "3", "a", "b", "c"},
+		},
+		{
+			name:     "Alternate Values",
+			input:    `echo ${NAME:+yes} ${UNSET_VARIABLE:+no}`,
+			expected: []string{"yes"},
+		},
+		{
+			name:     "Length",
+			input:    `echo ${#FILE} ${#UNSET_VARIABLE}`,
+			expected: []string{"7", "0"},
+		},
+		{
+			name:     "Prefix And Suffix Removal",
+			input:    `echo ${FILE%.go} ${FILEPATH##*/} ${FILEPATH#*/} ${FILEPATH%%.*} ${FILEPATH%.*}`,
+			expected: []string{"main", "gosh.tar.gz", "usr/local/bin/gosh.tar.gz", "/usr/local/bin/gosh", "/usr/local/bin/gosh.tar"},
+		},
+		{
+			name:     "Command Substitution",
+			input:    `echo $(echo a   b) "$(echo a   b)" ` + "`echo $NAME`",
+			expected: []string{"a", "b", "a b", "gosh"},
+		},
+		{
+			name:     "Nested Command Substitution",
+			input:    `echo "<$(echo "$(echo inner) outer")>" x$(echo ')')`,
+			expected: []string{"<inner outer>", "x)"},
+		},
+		{
+			name:     "Command Substitution With Case And Comments",
+			input:    "echo $(case x in x) echo y;; esac) $(echo a # comment )\n) $( (echo sub) )",
+			expected: []string{"y", "a", "sub"},
+		},
+		{
+			name:     "Command Substitution Trims Trailing Newlines",
+			input:    `echo "$(printf 'one\n\n\n')"`,
+			expected: []string{"one"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, err := parseCommand(t, tt.input).Expand()
+			if err != nil {
+				t.Fatalf("Expand(%q) returned error: %v", tt.input, err)
+			}
+
+			if !slices.Equal(command.args, tt.expected) {
+				t.Errorf("Expand(%q) = %q, expected: %q", tt.input, command.args, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExpandAssignDefault(t *testing.T) {
+
+	t.Setenv("ASSIGNED", "")
+
+	command, err := parseCommand(t, `echo ${ASSIGNED:=value}`).Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := lookupVar("ASSIGNED"); got != "value" || command.args[0] != "value" {
+		t.Errorf("${ASSIGNED:=value} set %q and expanded to %q, expected: %q", got, command.args[0], "value")
+	}
+
+	command, err = parseCommand(t, `echo ${QUOTED:="a  b"}`).Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Unsetenv("QUOTED") })
+
+	if got, _ := lookupVar("QUOTED"); got != "a  b" || !slices.Equal(command.args, []string{"a  b"}) {
+		t.Errorf(`${QUOTED:="a  b"} set %q and expanded to %q, expected: %q`, got, command.args, "a  b")
+	}
+}
+
+func TestExpandErrorIfUnset(t *testing.T) {
+
+	_, err := parseCommand(t, `echo ${UNSET_VARIABLE:?is required}`).Expand()
+
+	if err == nil || err.Error() != "UNSET_VARIABLE: is required" {
+		t.Errorf("Expand() error = %v, expected: %q", err, "UNSET_VARIABLE: is required")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "main.rs", false},
+		{"*/", "a/b/", true},
+		{"?.txt", "a.txt", true},
+		{"[a-c]*", "bee", true},
+		{"[!a-c]*", "bee", false},
+		{`\*`, "*", true},
+		{"[", "[", true},
+	}
+
+	for _, tt := range tests {
+		if got := MatchPattern(tt.pattern, tt.name); got != tt.expected {
+			t.Errorf("MatchPattern(%q, %q) = %v, expected: %v", tt.pattern, tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestExpandPathnames(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", "c.txt", ".hidden.go", "*.go", "sub/s.go", "sub/deep/d.go"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+	t.Setenv("PATTERN", "*.txt")
+
+	tests := []struct {
+		name     string
+		input    string
+		option   string
+		expected []string
+	}{
+		{name: "Star", input: `echo *.go`, expected: []string{"*.go", "a.go", "b.go"}},
+		{name: "Quoted Metacharacters Stay Literal", input: `echo "*.go" '*'.go \*.go`, expected: []string{"*.go", "*.go", "*.go"}},
+		{name: "Hidden Files", input: `echo .*.go`, expected: []string{".hidden.go"}},
+		{name: "Question Mark And Brackets", input: `echo ?.txt [ab].go`, expected: []string{"c.txt", "a.go", "b.go"}},
+		{name: "Directories", input: `echo */ sub/*/*.go`, expected: []string{"sub/", "sub/deep/d.go"}},
+		{name: "Unquoted Variable", input: `echo $PATTERN "$PATTERN"`, expected: []string{"c.txt", "*.txt"}},
+		{name: "No Match Is Kept", input: `echo *.rs`, expected: []string{"*.rs"}},
+		{name: "Nullglob", input: `echo *.rs`, option: "nullglob", expected: nil},
+		{name: "Globstar", input: `echo **/*.go`, option: "globstar", expected: []string{"*.go", "a.go", "b.go", "sub/deep/d.go", "sub/s.go"}},
+		{name: "Double Star Without Globstar", input: `echo **/*.go`, expected: []string{"sub/s.go"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.option != "" {
+				globOptions[tt.option] = true
+				defer func() { globOptions[tt.option] = false }()
+			}
+
+			command, err := parseCommand(t, tt.input).Expand()
+			if err != nil {
+				t.Fatalf("Expand(%q) returned error: %v", tt.input, err)
+			}
+
+			if !slices.Equal(command.args, tt.expected) {
+				t.Errorf("Expand(%q) = %q, expected: %q", tt.input, command.args, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExpandFailglob(t *testing.T) {
+
+	t.Chdir(t.TempDir())
+	globOptions["failglob"] = true
+	defer func() { globOptions["failglob"] = false }()
+
+	_, err := parseCommand(t, `echo *.rs`).Expand()
+
+	if err == nil || err.Error() != "no match: *.rs" {
+		t.Errorf("Expand() error = %v, expected: %q", err, "no match: *.rs")
+	}
+}
+
+func TestExpandBracesAndTilde(t *testing.T) {
+
+	t.Setenv("HOME", "/home/gosh")
+	t.Setenv("OLDPWD", "/previous")
+	t.Setenv("NAME", "gosh")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			name:     "Comma Lists",
+			input:    `echo file{,.bak} src/{api,db} a{b,c{d,e}}f`,
+			expected: []string{"file", "file.bak", "src/api", "src/db", "abf", "acdf", "acef"},
+		},
+		{
+			name:     "Sequences",
+			input:    `echo {1..3} {3..1} {01..03} {a..e..2} {-1..1}`,
+			expected: []string{"1", "2", "3", "3", "2", "1", "01", "02", "03", "a", "c", "e", "-1", "0", "1"},
+		},
+		{
+			name:     "Several Brace Expressions",
+			input:    `echo a{b,c}d{1..2} {x,y}{1,2}{+,-}`,
+			expected: []string{"abd1", "abd2", "acd1", "acd2", "x1+", "x1-", "x2+", "x2-", "y1+", "y1-", "y2+", "y2-"},
+		},
+		{
+			name:     "Sequences At The Limits",
+			input:    `echo {9223372036854775806..9223372036854775807} {1..3..9223372036854775807} {-9223372036854775807..-9223372036854775808} {9999999999999999999..1} {1..2..99999999999999999999}`,
+			expected: []string{"9223372036854775806", "9223372036854775807", "1", "-9223372036854775807", "-9223372036854775808", "{9999999999999999999..1}", "{1..2..99999999999999999999}"},
+		},
+		{
+			name:     "Not Brace Expressions",
+			input:    `echo "{a,b}" \{a,b} {a} {} {1..b}`,
+			expected: []string{"{a,b}", "{a,b}", "{a}", "{}", "{1..b}"},
+		},
+		{
+			name:     "Braces Before Parameters",
+			input:    `echo {$NAME,x}.go`,
+			expected: []string{"gosh.go", "x.go"},
+		},
+		{
+			name:     "Tilde",
+			input:    `echo ~ ~/bin ~- a~b "~" \~ ~"/x"`,
+			expected: []string{"/home/gosh", "/home/gosh/bin", "/previous", "a~b", "~", "~", "~/x"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, err := parseCommand(t, tt.input).Expand()
+			if err != nil {
+				t.Fatalf("Expand(%q) returned error: %v", tt.input, err)
+			}
+
+			if !slices.Equal(command.args, tt.expected) {
+				t.Errorf("Expand(%q) = %q, expected: %q", tt.input, command.args, tt.expected)
+			}
+		})
+	}
+
+	command, err := parseCommand(t, `BIN=~/bin:~/go/bin:x~ cat <~/in`).Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "BIN=/home/gosh/bin:/home/gosh/go/bin:x~"; command.env[0] != expected {
+		t.Errorf("assignment expanded to %q, expected: %q", command.env[0], expected)
+	}
+	if expected := "/home/gosh/in"; command.redirections[0].fileName != expected {
+		t.Errorf("redirection target expanded to %q, expected: %q", command.redirections[0].fileName, expected)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fcBuiltin lists, edits or re-executes commands of the history.
+//
+//	fc [-e editor] [-lnr] [first [last]]
+//	fc -s [old=new] [command]
+//
+// first and last are history numbers, negative ones counting back from the
+// previous command, or the last command starting with a string. `-l` lists
+// the commands, the last 16 by default, `-n` without their numbers and `-r`
+// in reverse order. Otherwise the commands, the previous one by default,
+// are edited with the editor, FCEDIT, EDITOR or vi, and run when it exits
+// successfully. `-s` runs a command again, with old replaced by new, and is
+// also what `-e -` does. The commands run take the place of fc in the
+// history.
+func fcBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+
+	editor, list, numbered, reverse, again := "", false, true, false, false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' && !isDigit(args[0][1]) {
+		option := args[0]
+		args = args[1:]
+		if option == "--" {
+			break
+		}
+		for _, flag := range option[1:] {
+			switch flag {
+			case 'e':
+				if len(args) == 0 {
+					fmt.Fprintln(stderr, "fc: -e: option requires an argument")
+					return fcUsage(stderr)
+				}
+				editor = args[0]
+				args = args[1:]
+			case 'l':
+				list = true
+			case 'n':
+				numbered = false
+			case 'r':
+				reverse = true
+			case 's':
+				again = true
+			default:
+				fmt.Fprintf(stderr, "fc: -%c: invalid option\n", flag)
+				return fcUsage(stderr)
+			}
+		}
+	}
+
+	hist := GetHistory()
+	entries := hist.Entries()
+	if lineInHistory && len(entries) > 0 {
+		// fc does not pick itself, and the commands it runs take its place
+		entries = entries[:len(entries)-1]
+		if !list {
+			forgetCommandLine(hist)
+		}
+	}
+
+	if again || editor == "-" {
+		return fcAgain(hist, entries, args, stdin, stdout, stderr)
+	}
+	if len(args) > 2 {
+		fmt.Fprintln(stderr, "fc: too many arguments")
+		return fcUsage(stderr)
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(stderr, "fc: history specification out of range")
+		return ExitStatus(1)
+	}
+
+	first, last := "-1", ""
+	if list {
+		first, last = "-16", "-1"
+	}
+	if len(args) > 0 {
+		first = args[0]
+	}
+	if len(args) > 1 {
+		last = args[1]
+	} else if !list {
+		last = first
+	}
+	from, err := historyPosition(entries, first, list)
+	if err != nil {
+		fmt.Fprintf(stderr, "fc: %v\n", err)
+		return ExitStatus(1)
+	}
+	to, err := historyPosition(entries, last, list)
+	if err != nil {
+		fmt.Fprintf(stderr, "fc: %v\n", err)
+		return ExitStatus(1)
+	}
+
+	// a range from a later command to an earlier one goes backwards
+	var selected []int
+	for i := min(from, to); i <= max(from, to); i++ {
+		selected = append(selected, i)
+	}
+	if from > to != reverse {
+		slices.Reverse(selected)
+	}
+
+	if list {
+		for _, i := range selected {
+			if numbered {
+				fmt.Fprintf(stdout, "%d\t %s\n", i+1, entries[i].Command)
+			} else {
+				fmt.Fprintf(stdout, "\t %s\n", entries[i].Command)
+			}
+		}
+		return nil
+	}
+
+	var commands strings.Builder
+	for _, i := range selected {
+		commands.WriteString(entries[i].Command + "\n")
+	}
+	edited, err := editCommands(editor, commands.String(), &Streams{Stdin: stdin, Stdout: stdout, Stderr: stderr})
+	if err != nil {
+		return err
+	}
+	return fcRun(hist, edited, stdin, stdout, stderr)
+}
+
+func fcUsage(stderr io.Writer) error {
+	fmt.Fprintln(stderr, "fc: usage: fc [-e ename] [-lnr] [first] [last] or fc -s [pat=rep] [command]")
+	return ExitStatus(2)
+}
+
+// fcAgain runs a command of entries again, the previous one or the one
+// args name, after replacing the old=new in args.
+func fcAgain(hist *History, entries []HistoryEntry, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	var old, replacement string
+	if len(args) > 0 && strings.Contains(args[0], "=") {
+		old, replacement, _ = strings.Cut(args[0], "=")
+		args = args[1:]
+	}
+	if len(args) > 1 {
+		fmt.Fprintln(stderr, "fc: too many arguments")
+		return fcUsage(stderr)
+	}
+	spec := "-1"
+	if len(args) > 0 {
+		spec = args[0]
+	}
+	i, err := historyPosition(entries, spec, false)
+	if err != nil {
+		fmt.Fprintf(stderr, "fc: %v\n", err)
+		return ExitStatus(1)
+	}
+
+	command := entries[i].Command
+	if old != "" {
+		command = strings.ReplaceAll(command, old, replacement)
+	}
+	return fcRun(hist, command, stdin, stdout, stderr)
+}
+
+// fcRun prints commands, stores them in the history and runs them.
+func fcRun(hist *History, commands string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	commands = strings.TrimRight(commands, "\n")
+	if strings.TrimSpace(commands) == "" {
+		return nil
+	}
+	fmt.Fprintln(stdout, commands)
+	hist.Add(commands)
+	if status := executeLine(commands, &Streams{Stdin: stdin, Stdout: stdout, Stderr: stderr}); status != 0 {
+		return ExitStatus(status)
+	}
+	return nil
+}
+
+// historyPosition returns the index in entries of the command that spec
+// names: a history number, a negative offset from the end, or the last
+// command starting with spec. Numbers out of the history are brought back
+// into it when clamp is set, as when listing.
+func historyPosition(entries []HistoryEntry, spec string, clamp bool) (int, error) {
+	n, err := strconv.Atoi(spec)
+	if err != nil {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if strings.HasPrefix(entries[i].Command, spec) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("%s: no command found", spec)
+	}
+
+	i := n - 1
+	if n <= 0 {
+		i = len(entries) + n
+		if n == 0 {
+			i = len(entries) - 1
+		}
+	}
+	if i < 0 || i >= len(entries) {
+		if !clamp {
+			return 0, fmt.Errorf("%s: history specification out of range", spec)
+		}
+		i = min(max(i, 0), len(entries)-1)
+	}
+	return i, nil
+}
+
+// editCommands has the user edit commands with editor, or FCEDIT, EDITOR or
+// vi, in a temporary file, and returns the file once edited. The editor
+// failing cancels the edit.
+func editCommands(editor string, commands string, streams *Streams) (string, error) {
+	for _, name := range []string{"FCEDIT", "EDITOR"} {
+		if editor == "" {
+			editor = os.Getenv(name)
+		}
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	file, err := os.CreateTemp("", "gosh-fc-*.sh")
+	if err != nil {
+		fmt.Fprintf(streams.Stderr, "fc: %v\n", err)
+		return "", ExitStatus(1)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(commands)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(streams.Stderr, "fc: %v\n", err)
+		return "", ExitStatus(1)
+	}
+
+	// the editor is a command line, which may have arguments
+	if status := executeLine(editor+" "+quoteWord(file.Name()), streams); status != 0 {
+		return "", ExitStatus(status)
+	}
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		fmt.Fprintf(streams.Stderr, "fc: %v\n", err)
+		return "", ExitStatus(1)
+	}
+	return string(edited), nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"strings"
@@ -24,19 +27,87 @@ func isExecutable(directoryPath string, target string) (bool, string) {
 	return false, ""
 }
 
-func SetIO(ioDetails *map[int]*Redirection, cmd Executable) {
-	cmd.SetStdin(openFile(GetOrDefault(*ioDetails, syscall.Stdin, NewRedirection("/dev/stdin")), syscall.Stdin, os.O_RDONLY))
-	cmd.SetStdout(openFile(GetOrDefault(*ioDetails, syscall.Stdout, NewRedirection("/dev/stdout")), syscall.Stdout, os.O_WRONLY))
-	cmd.SetStderr(openFile(GetOrDefault(*ioDetails, syscall.Stderr, NewRedirection("/dev/stderr")), syscall.Stderr, os.O_WRONLY))
+// SetIO connects cmd to its redirections, falling back to streams for the
+// descriptors that are not redirected.
+func SetIO(ioDetails []*Redirection, cmd Executable, streams *Streams, r *ResourceManager) error {
+	redirected, err := openRedirections(ioDetails, streams, r)
+	if err != nil {
+		return err
+	}
+	cmd.SetStdin(redirected.Stdin)
+	cmd.SetStdout(redirected.Stdout)
+	cmd.SetStderr(redirected.Stderr)
+	cmd.SetExtraFiles(redirected.Extra)
+	return nil
 }
 
-func openFile(r *Redirection, defaultFd int, mode int) *os.File {
+// openRedirections applies redirections, from left to right, on top of
+// streams, so that `>log 2>&1` sends both outputs to log while `2>&1 >log`
+// only sends the standard output there. The files it opens are handed to r,
+// which closes them once the commands are done.
+func openRedirections(redirections []*Redirection, streams *Streams, r *ResourceManager) (*Streams, error) {
+	result := *streams
+	result.Extra = maps.Clone(streams.Extra)
+
+	for _, redirection := range redirections {
+		switch {
+		case redirection.op == "<&" || redirection.op == ">&":
+			if err := result.duplicate(redirection.fd, redirection.fileName); err != nil {
+				return nil, err
+			}
+			continue
+		case isStandardIoFile(redirection.fileName):
+			// /dev/stdout and the like name the shell's descriptors, which
+			// are not necessarily the process ones
+			source := strings.TrimPrefix(redirection.fileName, "/dev/std")
+			fd := map[string]string{"in": "0", "out": "1", "err": "2"}[source]
+			if err := result.duplicate(redirection.fd, fd); err != nil {
+				return nil, err
+			}
+			if redirection.op == "&>" || redirection.op == "&>>" {
+				result.Stderr = result.Stdout
+			}
+			continue
+		}
 
-	if isStandardIoFile(r.fileName) {
-		return os.NewFile(uintptr(defaultFd), r.fileName)
+		var file *os.File
+		var err error
+		switch redirection.op {
+		case "<<", "<<-", "<<<":
+			file, err = inputFile(redirection.input)
+		case "<":
+			file, err = openFile(redirection, os.O_RDONLY)
+		case "<>":
+			file, err = openFile(redirection, os.O_RDWR)
+		default:
+			file, err = openFile(redirection, os.O_WRONLY)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(redirection.op, "<") {
+			r.AddReader(file)
+		} else {
+			r.AddWriter(file)
+		}
+		if redirection.op == "&>" || redirection.op == "&>>" {
+			result.Stdout, result.Stderr = file, file
+			continue
+		}
+		result.set(redirection.fd, file)
 	}
+	return &result, nil
+}
 
-	flags := mode | os.O_CREATE
+// openFile opens the target of a redirection. With the noclobber option set,
+// `>` refuses to truncate an existing regular file, which `>|` still does.
+func openFile(r *Redirection, mode int) (*os.File, error) {
+
+	flags := mode
+	if mode != os.O_RDONLY {
+		flags |= os.O_CREATE
+	}
 
 	if r.appendOnly {
 		flags |= os.O_APPEND
@@ -44,13 +115,34 @@ func openFile(r *Redirection, defaultFd int, mode int) *os.File {
 		flags |= os.O_TRUNC
 	}
 
-	fd, err := syscall.Open(r.fileName, flags, 0644)
+	if (r.op == ">" || r.op == "&>") && shellOptions["noclobber"] {
+		if info, err := os.Stat(r.fileName); err == nil && info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s: cannot overwrite existing file", r.fileName)
+		}
+	}
+
+	file, err := os.OpenFile(r.fileName, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", r.fileName, errors.Unwrap(err))
+	}
+	return file, nil
+}
 
+// inputFile returns an unlinked temporary file holding the text of a
+// here-document or here-string, ready to be read from the start.
+func inputFile(text string) (*os.File, error) {
+	file, err := os.CreateTemp("", shellName+"-heredoc-")
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
+	os.Remove(file.Name())
 
-	return os.NewFile(uintptr(fd), r.fileName)
+	if _, err := file.WriteString(text); err != nil {
+		file.Close()
+		return nil, err
+	}
+	file.Seek(0, io.SeekStart)
+	return file, nil
 }
 
 func Open(path string, mode int, isAppendOnly bool) (*os.File, error) {
@@ -111,6 +203,17 @@ func SearchAllExecutable(commandPrefix string) []string {
 
 func isExternal(target string) (bool, string) {
 
+	// a name with a slash is a path and is not searched for in PATH; it is
+	// kept as typed, since joining it would turn ./run into run, which
+	// exec.Command looks for in PATH
+	if strings.Contains(target, "/") {
+		stat, err := os.Stat(target)
+		if err != nil || stat.IsDir() || stat.Mode()&0100 == 0 {
+			return false, ""
+		}
+		return true, target
+	}
+
 	allPaths, ok := os.LookupEnv("PATH")
 	if !ok {
 		return false, ""
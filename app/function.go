@@ -0,0 +1,60 @@
+package main
+
+// functions holds the shell functions defined so far, by name.
+var functions = map[string]*FunctionDefinition{}
+
+// functionLevel counts the function calls in progress; `return` is only
+// allowed inside one.
+var functionLevel int
+
+// callFunction runs a function with args as its positional parameters.
+func callFunction(function *FunctionDefinition, args []string, streams *Streams) int {
+	params := positionalParams
+	positionalParams = args
+	localScopes = append(localScopes, map[string]savedVar{})
+	functionLevel++
+
+	defer func() {
+		runTrap("RETURN")
+		functionLevel--
+		popScope()
+		positionalParams = params
+		if pendingFlow == flowReturn {
+			pendingFlow = flowNone
+		}
+	}()
+
+	return execute(function.body, streams)
+}
+
+// FunctionCommand runs a shell function as one element of a pipeline.
+type FunctionCommand struct {
+	NodeCommand
+	function *FunctionDefinition
+	args     []string
+	// env are the assignments before the name, set while it runs
+	env []string
+}
+
+func NewFunctionCommand(function *FunctionDefinition, args []string) *FunctionCommand {
+	return &FunctionCommand{
+		NodeCommand: NodeCommand{node: function, done: make(chan int)},
+		function:    function,
+		args:        args,
+	}
+}
+
+func (f *FunctionCommand) GetCommandType() string {
+	return "FUNCTION"
+}
+
+func (f *FunctionCommand) Start() error {
+	go func() {
+		restore := applyTemporaryAssignments(f.env)
+		status := callFunction(f.function, f.args, &f.streams)
+		restore()
+		closeAll(f.closers)
+		f.done <- status
+	}()
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// globOptions are the `shopt` options controlling pathname expansion. By
+// default a pattern matching nothing is left as it is; nullglob removes it
+// instead and failglob makes the command fail. globstar lets `**` match any
+// number of directories.
+var globOptions = map[string]bool{
+	"nullglob": false,
+	"failglob": false,
+	"globstar": false,
+}
+
+// hasGlobMeta reports whether pattern has an unescaped `*`, `?` or a bracket
+// expression.
+func hasGlobMeta(pattern string) bool {
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			i++
+		case '*', '?':
+			return true
+		case '[':
+			if strings.ContainsRune(string(runes[i+1:]), ']') {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// glob returns the sorted paths matching pattern, in which the characters
+// that were quoted are escaped with a backslash. Like in other shells,
+// wildcards do not match a leading `.` in a file name unless the pattern
+// starts with one.
+func glob(pattern string) []string {
+	paths := []string{""}
+	if strings.HasPrefix(pattern, "/") {
+		paths = []string{"/"}
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		var matches []string
+		for _, dir := range paths {
+			matches = append(matches, globSegment(dir, segment, last)...)
+		}
+		paths = matches
+	}
+
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// globSegment matches one segment of a pattern against the entries of dir,
+// which is empty for the current directory or ends with a slash. The
+// matches get a trailing slash unless they are for the last segment.
+func globSegment(dir string, segment string, last bool) []string {
+	suffix := "/"
+	if last {
+		suffix = ""
+	}
+
+	switch {
+	case segment == "":
+		// a trailing or doubled slash only matches directories
+		if dir == "" || isDirectory(dir) {
+			return []string{dir}
+		}
+		return nil
+	case !hasGlobMeta(segment):
+		path := dir + unescapePattern(segment)
+		if _, err := os.Lstat(path); err != nil {
+			return nil
+		}
+		return []string{path + suffix}
+	case segment == "**" && globOptions["globstar"]:
+		return globStar(dir, last)
+	}
+
+	entries, err := os.ReadDir(directoryOrDot(dir))
+	if err != nil {
+		return nil
+	}
+
+	var matches []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(segment, ".") {
+			continue
+		}
+		if !MatchPattern(segment, name) {
+			continue
+		}
+		if !last && !isDirectory(dir+name) {
+			continue
+		}
+		matches = append(matches, dir+name+suffix)
+	}
+	return matches
+}
+
+// globStar matches `**`: dir itself and every directory below it, and also
+// all the files below it when `**` is the last segment.
+func globStar(dir string, last bool) []string {
+	var matches []string
+	if !last {
+		matches = append(matches, dir)
+	}
+
+	root := directoryOrDot(dir)
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relative, _ := filepath.Rel(root, path)
+		switch {
+		case entry.IsDir() && !last:
+			matches = append(matches, dir+relative+"/")
+		case last:
+			matches = append(matches, dir+relative)
+		}
+		return nil
+	})
+	return matches
+}
+
+func directoryOrDot(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
+
+func isDirectory(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// unescapePattern removes the backslashes escaping characters in a pattern.
+func unescapePattern(pattern string) string {
+	var unescaped strings.Builder
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '\\' && i+1 < len(runes) {
+			i++
+		}
+		unescaped.WriteRune(runes[i])
+	}
+	return unescaped.String()
+}
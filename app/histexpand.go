@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lastSubstitution is the last `:s/old/new/` of history expansion, which
+// `:&`, `:s//new/` and `^old^new` reuse parts of.
+var lastSubstitution struct {
+	old, replacement string
+}
+
+// expandHistory performs the history expansion of an interactive command
+// line. `!!` is the previous command, `!n` command n, `!-n` the n-th
+// previous, `!string` the last command starting with string and `!?string?`
+// the last containing it. A word designator after `:` picks words of the
+// command: `0`, `n`, `x-y`, `^` (1), `$` (the last), `*` (all but the
+// first); `^`, `$` and `*` need no `:`, and `!:2` or `!$` use the previous
+// command. Modifiers follow, each after `:`: `h` and `t` keep the head or
+// tail of a path, `r` removes a suffix and `e` keeps it, `s/old/new/`
+// substitutes the first old, `gs/old/new/` all of them, `&` repeats the
+// last substitution, `q` quotes, and `p` prints the line instead of running
+// it. `^old^new` on its own at the start of the line is `!!:s/old/new/`.
+//
+// There is no expansion in single quotes, after a backslash, or for a `!`
+// followed by a blank, `=`, `(` or `"`, nor in `$!`, `${!name}` and `[!...]`.
+// expandHistory returns the expanded line and whether it is to be run.
+func expandHistory(line string, hist *History) (string, bool, error) {
+	if strings.HasPrefix(line, "^") {
+		line = "!!:s" + line
+	}
+
+	var expanded strings.Builder
+	run := true
+	inSingle, inDouble := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && !inSingle && i+1 < len(line):
+			expanded.WriteString(line[i : i+2])
+			i++
+			continue
+		case c == '\'' && !inDouble:
+			inSingle = !inSingle
+		case c == '"' && !inSingle:
+			inDouble = !inDouble
+		case c == '!' && !inSingle && !inhibitsHistory(line, i):
+			text, end, printOnly, err := expandEvent(line, i, expanded.String(), hist)
+			if err != nil {
+				return "", false, err
+			}
+			expanded.WriteString(text)
+			run = run && !printOnly
+			i = end - 1
+			continue
+		}
+		expanded.WriteByte(c)
+	}
+	return expanded.String(), run, nil
+}
+
+// inhibitsHistory reports whether the `!` at i in line is left alone.
+func inhibitsHistory(line string, i int) bool {
+	if i+1 == len(line) || strings.IndexByte(" \t\n=(\"", line[i+1]) >= 0 {
+		return true
+	}
+	if strings.HasSuffix(line[:i], "$") || strings.HasSuffix(line[:i], "${") {
+		return true
+	}
+	return strings.HasSuffix(line[:i], "[") && strings.Contains(line[i:], "]")
+}
+
+// expandEvent expands the history reference starting with the `!` at start
+// in line, so far expanded into current for `!#`. It returns the text of
+// the reference, where it ends in line, and whether `:p` was given.
+func expandEvent(line string, start int, current string, hist *History) (string, int, bool, error) {
+	i := start + 1
+	var event string
+	var ok bool
+
+	switch c := line[i]; {
+	case c == '!':
+		event, ok = hist.Get(hist.GetHistoryIndex()-1), hist.GetHistoryIndex() > 0
+		i++
+	case c == '#':
+		event, ok = current, true
+		i++
+	case c == ':' || c == '^' || c == '$' || c == '*':
+		// the word designator of the previous command
+		event, ok = hist.Get(hist.GetHistoryIndex()-1), hist.GetHistoryIndex() > 0
+	case isDigit(c) || c == '-' && i+1 < len(line) && isDigit(line[i+1]):
+		end := i + 1
+		for end < len(line) && isDigit(line[end]) {
+			end++
+		}
+		n, _ := strconv.Atoi(line[i:end])
+		if n < 0 {
+			n += hist.GetHistoryIndex() + 1
+		}
+		event, ok = hist.Get(n-1), n >= 1 && n <= hist.GetHistoryIndex()
+		i = end
+	case c == '?':
+		end := strings.IndexAny(line[i+1:], "?\n")
+		if end < 0 {
+			end = len(line) - i - 1
+		}
+		search := line[i+1 : i+1+end]
+		i += end + 1
+		if i < len(line) && line[i] == '?' {
+			i++
+		}
+		var index int
+		index, _, ok = hist.Search(search, hist.GetHistoryIndex()-1, false)
+		ok = ok && search != ""
+		event = hist.Get(index)
+	default:
+		end := i
+		for end < len(line) && strings.IndexByte(" \t\n:;&|<>()'\"`", line[end]) < 0 {
+			end++
+		}
+		index := hist.GetHistoryIndex()
+		event, ok = hist.Prev(&index, line[i:end], "")
+		i = end
+	}
+	if !ok {
+		return "", 0, false, fmt.Errorf("%s: event not found", line[start:i])
+	}
+
+	text, i, err := selectWords(event, line, i)
+	if err != nil {
+		return "", 0, false, err
+	}
+	return applyModifiers(text, line, i)
+}
+
+// selectWords applies the word designator at i in line, if any, to event
+// and returns the words selected and where the designator ends.
+func selectWords(event string, line string, i int) (string, int, error) {
+	designator := i
+	if i < len(line) && line[i] == ':' && i+1 < len(line) && strings.IndexByte("0123456789^$*-", line[i+1]) >= 0 {
+		designator++
+	} else if i >= len(line) || strings.IndexByte("^$*", line[i]) < 0 {
+		return event, i, nil
+	}
+
+	words := historyWords(event)
+	last := len(words) - 1
+	// word parses a word number at j, or ^ and $
+	word := func(j int) (int, int, bool) {
+		switch {
+		case j >= len(line):
+			return 0, j, false
+		case line[j] == '^':
+			return 1, j + 1, true
+		case line[j] == '$':
+			return last, j + 1, true
+		}
+		end := j
+		for end < len(line) && isDigit(line[end]) {
+			end++
+		}
+		n, err := strconv.Atoi(line[j:end])
+		return n, end, err == nil
+	}
+
+	j := designator
+	var from, to int
+	// ranges to the last word, like `*`, may be empty
+	mayBeEmpty := false
+	if line[j] == '*' {
+		from, to, mayBeEmpty = 1, last, true
+		j++
+	} else {
+		var ok bool
+		if line[j] != '-' {
+			if from, j, ok = word(j); !ok {
+				return "", 0, badWordSpecifier(line, designator)
+			}
+		}
+		to = from
+		switch {
+		case j < len(line) && line[j] == '*':
+			to, mayBeEmpty = last, true
+			j++
+		case j < len(line) && line[j] == '-':
+			if to, j, ok = word(j + 1); !ok {
+				// x- leaves out the last word
+				to, mayBeEmpty = last-1, true
+			}
+		}
+	}
+	if from > to && mayBeEmpty {
+		return "", j, nil
+	}
+	if from > to || to > last {
+		return "", 0, badWordSpecifier(line, designator)
+	}
+	return strings.Join(words[from:to+1], " "), j, nil
+}
+
+func badWordSpecifier(line string, i int) error {
+	end := i
+	for end < len(line) && strings.IndexByte(" \t\n", line[end]) < 0 {
+		end++
+	}
+	return fmt.Errorf("%s: bad word specifier", line[i:end])
+}
+
+// applyModifiers applies the modifiers at i in line to text, and returns
+// the result, where the modifiers end and whether `:p` was one of them.
+func applyModifiers(text string, line string, i int) (string, int, bool, error) {
+	printOnly := false
+	for i+1 < len(line) && line[i] == ':' {
+		start := i
+		i++
+		global := false
+		if line[i] == 'g' || line[i] == 'a' {
+			global = true
+			i++
+			if i == len(line) {
+				return "", 0, false, fmt.Errorf("%s: unrecognized history modifier", line[start:])
+			}
+		}
+
+		switch line[i] {
+		case 'h':
+			if slash := strings.LastIndexByte(text, '/'); slash >= 0 {
+				text = text[:slash]
+			}
+			i++
+		case 't':
+			text = text[strings.LastIndexByte(text, '/')+1:]
+			i++
+		case 'r':
+			if dot := strings.LastIndexByte(text, '.'); dot > strings.LastIndexByte(text, '/') {
+				text = text[:dot]
+			}
+			i++
+		case 'e':
+			dot := strings.LastIndexByte(text, '.')
+			if dot <= strings.LastIndexByte(text, '/') {
+				dot = len(text)
+			}
+			text = text[dot:]
+			i++
+		case 'q':
+			text = quoteWord(text)
+			i++
+		case 'p':
+			printOnly = true
+			i++
+		case 's', '&':
+			if line[i] == 's' {
+				end, err := parseSubstitution(line, i+1)
+				if err != nil {
+					return "", 0, false, err
+				}
+				i = end
+			} else {
+				i++
+			}
+			old := lastSubstitution.old
+			if old == "" || !strings.Contains(text, old) {
+				return "", 0, false, fmt.Errorf("%s: substitution failed", line[start:i])
+			}
+			// & in the replacement is old, \& a literal &
+			replacement := strings.NewReplacer(`\&`, "&", "&", old).Replace(lastSubstitution.replacement)
+			if global {
+				text = strings.ReplaceAll(text, old, replacement)
+			} else {
+				text = strings.Replace(text, old, replacement, 1)
+			}
+		default:
+			if !isLetter(line[i]) {
+				// a colon of the command line, not a modifier
+				return text, start, printOnly, nil
+			}
+			return "", 0, false, fmt.Errorf("%s: unrecognized history modifier", line[start:i+1])
+		}
+	}
+	return text, i, printOnly, nil
+}
+
+// parseSubstitution parses the `/old/new/` of a `:s` modifier at i in line
+// into lastSubstitution, and returns where it ends. Any character can
+// delimit old and new, and a backslash quotes it; the last delimiter can be
+// left out at the end of the line. An empty old is the last one.
+func parseSubstitution(line string, i int) (int, error) {
+	if i >= len(line) {
+		return 0, errors.New("s: missing substitution")
+	}
+	delimiter := line[i]
+	i++
+
+	// part reads up to the next delimiter, or to the end of the line
+	part := func() string {
+		var s strings.Builder
+		for ; i < len(line) && line[i] != delimiter && line[i] != '\n'; i++ {
+			if line[i] == '\\' && i+1 < len(line) && (line[i+1] == delimiter || line[i+1] == '&') {
+				i++
+				if line[i] == '&' {
+					// a literal & is kept quoted for the replacement
+					s.WriteByte('\\')
+				}
+			}
+			s.WriteByte(line[i])
+		}
+		if i < len(line) && line[i] == delimiter {
+			i++
+		}
+		return s.String()
+	}
+
+	old := part()
+	replacement := part()
+	if old != "" {
+		lastSubstitution.old = old
+	}
+	lastSubstitution.replacement = replacement
+	return i, nil
+}
+
+// historyWords splits a command of the history into words at blanks, with
+// quoted blanks staying in their word.
+func historyWords(command string) []string {
+	var words []string
+	var word strings.Builder
+	var quote byte
+	inWord := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\\' && i+1 < len(command):
+			word.WriteByte(c)
+			i++
+			c = command[i]
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		}
+		word.WriteByte(c)
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -3,19 +3,52 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type History struct {
-	commands       []string
+	entries        []HistoryEntry
 	lock           sync.RWMutex
 	lastWriteIndex int
+
+	// readOffset is where HISTFILE was last read or written up to, and
+	// lastLine its line ending there
+	readOffset int64
+	lastLine   string
+}
+
+// HistoryEntry is a command of the history, with when, where and how it
+// ran. Plain history files only keep the command, extended ones its start
+// time, and JSON Lines ones everything. Durations are in nanoseconds in
+// JSON.
+type HistoryEntry struct {
+	Command  string        `json:"command"`
+	Start    time.Time     `json:"start,omitzero"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Status   int           `json:"status"`
+	Dir      string        `json:"cwd,omitempty"`
+	Session  string        `json:"session,omitempty"`
+	Host     string        `json:"host,omitempty"`
 }
 
+var (
+	// historySession tells the commands of this shell from the ones of
+	// other shells in the history file
+	historySession = rand.Text()[:8]
+	historyHost, _ = os.Hostname()
+)
+
 var (
 	history *History
 	once    sync.Once
@@ -24,104 +57,489 @@ var (
 func GetHistory() *History {
 
 	once.Do(func() {
-		history = &History{commands: make([]string, 0)}
+		history = &History{entries: make([]HistoryEntry, 0)}
 		if path, ok := os.LookupEnv("HISTFILE"); ok {
 			history.LoadHistory(path)
-			history.lastWriteIndex = len(history.commands)
+			history.lastWriteIndex = len(history.entries)
 		}
 	})
 
 	return history
 }
 
-func (h *History) Add(command string) {
+// Add saves command in the history, unless HISTCONTROL or HISTIGNORE leave
+// it out, and forgets the oldest commands past HISTSIZE.
+func (h *History) Add(command string) bool {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
-	h.commands = append(h.commands, command)
+	previous := ""
+	if len(h.entries) > 0 {
+		previous = h.entries[len(h.entries)-1].Command
+	}
+	if ignoredByHistory(command, previous) {
+		return false
+	}
+	if historyControl("erasedups") {
+		for i := len(h.entries) - 1; i >= 0; i-- {
+			if h.entries[i].Command == command {
+				h.remove(i)
+			}
+		}
+	}
+
+	dir, _ := os.Getwd()
+	h.entries = append(h.entries, HistoryEntry{
+		Command: command,
+		Start:   time.Now(),
+		Dir:     dir,
+		Session: historySession,
+		Host:    historyHost,
+	})
+	if size, ok := historyLimit("HISTSIZE"); ok {
+		h.keepLast(size)
+	}
+	return true
 }
 
-func (h *History) GetLast(count int) string {
+// Finish records the exit status and duration of command, the last one
+// added.
+func (h *History) Finish(command string, status int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.entries) == 0 {
+		return
+	}
+	entry := &h.entries[len(h.entries)-1]
+	if entry.Command == command && entry.Session == historySession && entry.Duration == 0 {
+		entry.Duration = time.Since(entry.Start)
+		entry.Status = status
+	}
+}
 
+// Entries returns a copy of the entries of the history.
+func (h *History) Entries() []HistoryEntry {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
 
-	start := max(0, len(h.commands)-count)
+	return slices.Clone(h.entries)
+}
+
+// Clear forgets all the commands.
+func (h *History) Clear() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.entries = nil
+	h.lastWriteIndex = 0
+}
+
+// Delete forgets the commands from index from to index to, included.
+func (h *History) Delete(from, to int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i := to; i >= from; i-- {
+		h.remove(i)
+	}
+}
+
+// forgetCommandLine removes the command line being run from the history, if
+// it was stored there, for the builtins storing other commands in its place.
+func forgetCommandLine(hist *History) {
+	if lineInHistory {
+		hist.RemoveLast()
+		lineInHistory = false
+	}
+}
+
+// RemoveLast forgets the last command, as the history builtin does with its
+// own command line when it stores others in its place.
+func (h *History) RemoveLast() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
 
-	var commands strings.Builder
-	for i := start; i < len(h.commands); i++ {
-		commands.WriteString(fmt.Sprintf("    %d  %s\n", (i + 1), h.commands[i]))
+	if len(h.entries) > 0 {
+		h.remove(len(h.entries) - 1)
 	}
-	return commands.String()
+}
 
+// remove forgets the command at index i.
+func (h *History) remove(i int) {
+	h.entries = append(h.entries[:i], h.entries[i+1:]...)
+	if i < h.lastWriteIndex {
+		h.lastWriteIndex--
+	}
+}
+
+// keepLast forgets all but the last n commands.
+func (h *History) keepLast(n int) {
+	if drop := len(h.entries) - n; drop > 0 {
+		h.entries = append(h.entries[:0], h.entries[drop:]...)
+		h.lastWriteIndex = max(h.lastWriteIndex-drop, 0)
+	}
 }
 
 func (h *History) GetHistoryIndex() int {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
 
-	return len(h.commands)
+	return len(h.entries)
 
 }
 
-func (h *History) Prev(historyIndex *int) string {
+// Prev moves *historyIndex back to the newest older command that starts
+// with prefix and differs from current, the line shown, and returns it. It
+// reports false, leaving *historyIndex alone, when there is none.
+func (h *History) Prev(historyIndex *int, prefix string, current string) (string, bool) {
 
-	h.lock.Lock()
-	defer h.lock.Unlock()
+	h.lock.RLock()
+	defer h.lock.RUnlock()
 
-	if len(h.commands) == 0 {
-		return ""
+	for i := min(*historyIndex, len(h.entries)) - 1; i >= 0; i-- {
+		if strings.HasPrefix(h.entries[i].Command, prefix) && h.entries[i].Command != current {
+			*historyIndex = i
+			return h.entries[i].Command, true
+		}
 	}
+	return "", false
+
+}
 
-	*historyIndex--
+// Next moves *historyIndex forward to the oldest newer command that starts
+// with prefix and differs from current, and returns it. Past the newest
+// command, *historyIndex is set to the end of the history and Next reports
+// false, for the line typed before moving back to be shown again.
+func (h *History) Next(historyIndex *int, prefix string, current string) (string, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
 
-	if *historyIndex < 0 {
-		*historyIndex = 0
-	} else if *historyIndex >= len(h.commands) {
-		*historyIndex = len(h.commands) - 1
+	for i := max(*historyIndex+1, 0); i < len(h.entries); i++ {
+		if strings.HasPrefix(h.entries[i].Command, prefix) && h.entries[i].Command != current {
+			*historyIndex = i
+			return h.entries[i].Command, true
+		}
 	}
+	*historyIndex = len(h.entries)
+	return "", false
 
-	lastCommand := h.commands[*historyIndex]
-	return lastCommand
+}
 
+// Search returns the index of the first command from start on, going back
+// to older commands or forward to newer ones, that contains query, and the
+// offset of query in it. A start past the commands starts at the last or
+// first one.
+func (h *History) Search(query string, start int, forward bool) (int, int, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	step := -1
+	if forward {
+		step = 1
+		start = max(start, 0)
+	} else {
+		start = min(start, len(h.entries)-1)
+	}
+	for i := start; i >= 0 && i < len(h.entries); i += step {
+		if offset := strings.Index(h.entries[i].Command, query); offset >= 0 {
+			return i, offset, true
+		}
+	}
+	return 0, 0, false
 }
 
-func (h *History) Next(historyIndex *int) string {
-	h.lock.Lock()
-	defer h.lock.Unlock()
+// Get returns the command at index.
+func (h *History) Get(index int) string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
 
-	if len(h.commands) == 0 {
+	if index < 0 || index >= len(h.entries) {
 		return ""
 	}
+	return h.entries[index].Command
+}
+
+// LoadHistory adds the commands of the history file at path.
+func (h *History) LoadHistory(path string) {
+	file, err := Open(path, os.O_RDONLY, false)
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if file == nil {
+		return
+	}
+
+	defer file.Close()
+
+	// other shells may be writing to the file
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_SH); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer unix.Flock(int(file.Fd()), unix.LOCK_UN)
 
-	*historyIndex++
+	h.lock.Lock()
+	defer h.lock.Unlock()
 
-	if *historyIndex < 0 {
-		*historyIndex = 0
-	} else if *historyIndex >= len(h.commands) {
-		*historyIndex = len(h.commands) - 1
+	var parser historyParser
+	readHistoryLines(file, func(line string) {
+		parser.add(line)
+		// only the last HISTSIZE commands of a long file are kept
+		if size, ok := historyLimit("HISTSIZE"); ok && len(parser.entries) > 2*size+1024 {
+			parser.entries = parser.entries[len(parser.entries)-size:]
+		}
+	})
+	h.entries = append(h.entries, parser.entries...)
+	if size, ok := historyLimit("HISTSIZE"); ok {
+		h.keepLast(size)
+	}
+	if path == os.Getenv("HISTFILE") {
+		h.markRead(file)
 	}
 
-	nextCommand := h.commands[*historyIndex]
-	return nextCommand
+}
 
+// WriteHistory writes the whole history to the file at path.
+func (h *History) WriteHistory(path string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastWriteIndex = 0
+	h.writeHistoryFile(path, true)
 }
 
-func (h *History) LoadHistory(path string) {
-	file, err := Open(path, os.O_RDONLY, false)
+// AppendHistory appends the commands not written yet to the file at path.
+func (h *History) AppendHistory(path string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.writeHistoryFile(path, false)
+}
 
+// ReadNew adds the commands appended to the history file at path since it
+// was last read or written.
+func (h *History) ReadNew(path string) {
+	file, err := Open(path, os.O_RDONLY, false)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-
 	if file == nil {
 		return
 	}
+	defer file.Close()
 
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_SH); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer unix.Flock(int(file.Fd()), unix.LOCK_UN)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := h.readNew(file); err != nil {
+		fmt.Println(err)
+	}
+	h.markRead(file)
+}
+
+// writeHistoryFile writes the commands not written yet to the file at path,
+// after what it holds or, with overwrite, in place of it. The file stays
+// locked meanwhile, so that shells sharing it, each appending its commands,
+// do not lose any. Before appending to HISTFILE with HISTSYNC=share, the
+// commands other shells appended since the last time are read.
+func (h *History) writeHistoryFile(path string, overwrite bool) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer unix.Flock(int(file.Fd()), unix.LOCK_UN)
+
+	shared := path == os.Getenv("HISTFILE")
+	if overwrite {
+		err = file.Truncate(0)
+	} else if shared && historySync() == "share" {
+		err = h.readNew(file)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		fmt.Println(err)
+		return
+	}
+	h.WriteFrom(file)
+	if err := truncateHistoryFile(file); err != nil {
+		fmt.Println(err)
+	}
+	if shared {
+		h.markRead(file)
+	}
+}
+
+// readNew adds the commands appended to the history file by other shells
+// since the last time it was read or written, before the commands of this
+// shell not written yet.
+func (h *History) readNew(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	start := h.readOffset
+	if !h.readUpTo(file, start) {
+		// the file changed under the end of what was read, when another
+		// shell truncated it: look for that end again
+		data, err := io.ReadAll(io.NewSectionReader(file, 0, info.Size()))
+		if err != nil {
+			return err
+		}
+		start = info.Size()
+		if i := bytes.LastIndex(data, []byte("\n"+h.lastLine)); h.lastLine != "" && i >= 0 {
+			start = int64(i + 1 + len(h.lastLine))
+		} else if h.lastLine != "" && bytes.HasPrefix(data, []byte(h.lastLine)) {
+			start = int64(len(h.lastLine))
+		}
+	}
+
+	// the format is the one of the whole file
+	var parser historyParser
+	if start > 0 {
+		parser.format = historyFileFormat(file)
+	}
+	err = readHistoryLines(io.NewSectionReader(file, start, info.Size()-start), parser.add)
+	h.entries = slices.Insert(h.entries, h.lastWriteIndex, parser.entries...)
+	h.lastWriteIndex += len(parser.entries)
+	if size, ok := historyLimit("HISTSIZE"); ok {
+		h.keepLast(size)
+	}
+	return err
+}
+
+// readUpTo reports whether the history file still ends at offset with the
+// last line read or written.
+func (h *History) readUpTo(file *os.File, offset int64) bool {
+	if h.lastLine == "" || offset < int64(len(h.lastLine)) {
+		return offset == 0
+	}
+	line := make([]byte, len(h.lastLine))
+	_, err := file.ReadAt(line, offset-int64(len(line)))
+	return err == nil && string(line) == h.lastLine
+}
+
+// markRead records the end of the history file as read: its size and its
+// last line, to find where it ended after other shells truncate it.
+func (h *History) markRead(file *os.File) {
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	h.readOffset = info.Size()
+
+	tail := make([]byte, min(info.Size(), 64*1024))
+	n, _ := file.ReadAt(tail, info.Size()-int64(len(tail)))
+	tail = tail[:n]
+	if i := bytes.LastIndexByte(bytes.TrimSuffix(tail, []byte{'\n'}), '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	h.lastLine = string(tail)
+}
+
+// SyncHistory appends the commands that ran to HISTFILE right away with
+// HISTSYNC=append, instead of when the shell exits, and with HISTSYNC=share
+// also picks up the ones other shells appended.
+func SyncHistory() {
+	path, ok := os.LookupEnv("HISTFILE")
+	if ok && historySync() != "" {
+		GetHistory().AppendHistory(path)
+	}
+}
+
+// historySync returns how HISTSYNC asks the history file to be shared.
+func historySync() string {
+	switch mode := os.Getenv("HISTSYNC"); mode {
+	case "append", "share":
+		return mode
+	}
+	return ""
+}
+
+// historyParser turns the lines of a history file into entries. The format
+// of the file is told by the look of its first line, whatever HISTFORMAT is
+// now: JSON Lines start with {, and in the extended format a #timestamp line
+// comes before each command, whose lines follow as they are. Any other file
+// has a command per line, which may well start with # or {.
+type historyParser struct {
+	entries []HistoryEntry
+	format  string
+	start   time.Time
+	// continued is set when the next line may carry on the last command of
+	// an extended file
+	continued bool
+}
+
+// detect sets the format of the file from its first line.
+func (p *historyParser) detect(line string) {
+	var entry HistoryEntry
+	switch _, timestamped := parseHistoryTimestamp(line); {
+	case timestamped:
+		p.format = "extended"
+	case decodeHistoryEntry(line, &entry):
+		p.format = "json"
+	default:
+		p.format = "plain"
+	}
+}
+
+func (p *historyParser) add(line string) {
+	if p.format == "" {
+		p.detect(line)
+	}
+
+	switch p.format {
+	case "json":
+		var entry HistoryEntry
+		if decodeHistoryEntry(line, &entry) {
+			p.entries = append(p.entries, entry)
+			return
+		}
+	case "extended":
+		if timestamp, ok := parseHistoryTimestamp(line); ok {
+			p.start, p.continued = timestamp, false
+			return
+		}
+		if p.continued {
+			p.entries[len(p.entries)-1].Command += "\n" + line
+			return
+		}
+		p.continued = true
+	}
+	p.entries = append(p.entries, HistoryEntry{Command: line, Start: p.start})
+	p.start = time.Time{}
+}
+
+// decodeHistoryEntry decodes a line of a JSON Lines history file into entry,
+// and reports whether it is one: an object with a command.
+func decodeHistoryEntry(line string, entry *HistoryEntry) bool {
+	return strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), entry) == nil && entry.Command != ""
+}
+
+// readHistoryLines calls add with each line read from r.
+func readHistoryLines(r io.Reader, add func(string)) error {
+	reader := bufio.NewReader(r)
 
 	var lineBuf bytes.Buffer
 
@@ -134,68 +552,263 @@ func (h *History) LoadHistory(path string) {
 
 		if err != nil {
 			fmt.Println(err)
-			break
+			return err
 		}
 
 		lineBuf.Write(part)
 
 		if !isPrefix {
-			h.commands = append(h.commands, lineBuf.String())
+			add(lineBuf.String())
 			lineBuf.Reset()
 		}
 	}
 
 	if lineBuf.Len() > 0 {
-		h.commands = append(h.commands, lineBuf.String())
+		add(lineBuf.String())
 		lineBuf.Reset()
 	}
+	return nil
+}
+
+// WriteFrom writes the commands not written yet to file, in the format set
+// by HISTFORMAT: `plain`, the default, has a command per line, `extended`
+// puts a #timestamp line before each command, like bash, and `json` writes
+// JSON Lines with all there is to know about the commands.
+func (h *History) WriteFrom(file *os.File) {
+	writer := bufio.NewWriter(file)
 
+	defer func() {
+		writer.Flush()
+	}()
+
+	format := historyFormat()
+	lastIndex := h.lastWriteIndex
+	for lastIndex < len(h.entries) {
+		if _, err := writer.WriteString(encodeHistoryEntry(h.entries[lastIndex], format)); err != nil {
+			h.lastWriteIndex = lastIndex
+			fmt.Println(err)
+			return
+		}
+		lastIndex++
+		h.lastWriteIndex = lastIndex
+	}
 }
 
-func (h *History) WriteHistory(path string) {
+// historyFormat returns the format HISTFORMAT asks history files to be
+// written in.
+func historyFormat() string {
+	switch format := os.Getenv("HISTFORMAT"); format {
+	case "json", "extended":
+		return format
+	}
+	return "plain"
+}
 
-	file, err := Open(path, os.O_WRONLY, false)
+// parseHistoryTimestamp parses the #timestamp lines of the extended format,
+// in seconds since the epoch.
+func parseHistoryTimestamp(line string) (time.Time, bool) {
+	digits, ok := strings.CutPrefix(line, "#")
+	if !ok || digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(digits, 10, 64)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return time.Time{}, false
 	}
-	defer file.Close()
+	if seconds == 0 {
+		// a command whose time is not known
+		return time.Time{}, true
+	}
+	return time.Unix(seconds, 0), true
+}
 
-	h.WriteFrom(file)
+// encodeHistoryEntry returns entry as written in a history file of format.
+func encodeHistoryEntry(entry HistoryEntry, format string) string {
+	switch format {
+	case "json":
+		data, _ := json.Marshal(entry)
+		return string(data) + "\n"
+	case "extended":
+		timestamp := int64(0)
+		if !entry.Start.IsZero() {
+			timestamp = entry.Start.Unix()
+		}
+		return fmt.Sprintf("#%d\n%s\n", timestamp, entry.Command)
+	}
+	return entry.Command + "\n"
 }
 
-func (h *History) AppendHistory(path string) {
-	file, err := Open(path, os.O_WRONLY, true)
+// truncateHistoryFile keeps only the last HISTFILESIZE lines of the
+// history file, or the last HISTSIZE commands when HISTFILESIZE is not set.
+// The lines are moved in place, the file being locked by the shells sharing
+// it.
+func truncateHistoryFile(file *os.File) error {
+	size, ok := historyLimit("HISTFILESIZE")
+	byCommand := false
+	if _, set := os.LookupEnv("HISTFILESIZE"); !set {
+		size, ok = historyLimit("HISTSIZE")
+		byCommand = true
+	}
+	if !ok {
+		return nil
+	}
+	info, err := file.Stat()
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
-	defer file.Close()
+	end := info.Size()
 
-	h.WriteFrom(file)
+	// the commands of an extended file start with their #timestamp line
+	extended := historyFileFormat(file) == "extended"
+	timestamp := func(line []byte) bool {
+		_, ok := parseHistoryTimestamp(strings.TrimSuffix(string(line), "\n"))
+		return ok
+	}
+	counted := func(line []byte) bool {
+		return !byCommand || !extended || timestamp(line)
+	}
+
+	// count first, so that the file is only rewritten when it is too long,
+	// and without reading it into memory
+	total := 0
+	err = scanHistoryLines(file, end, func(offset int64, line []byte) bool {
+		if counted(line) {
+			total++
+		}
+		return true
+	})
+	if err != nil || total <= size {
+		return err
+	}
 
+	// find where the lines kept start, which in an extended file is at a
+	// command, rather than in the middle of one cut in two
+	cut, skip := end, total-size
+	err = scanHistoryLines(file, end, func(offset int64, line []byte) bool {
+		if skip <= 0 && (!extended || timestamp(line)) {
+			cut = offset
+			return false
+		}
+		if counted(line) {
+			skip--
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	for offset := cut; offset < end; {
+		n, err := file.ReadAt(buf, offset)
+		if _, err := file.WriteAt(buf[:n], offset-cut); err != nil {
+			return err
+		}
+		offset += int64(n)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return file.Truncate(end - cut)
 }
 
-func (h *History) WriteFrom(file *os.File) {
-	writer := bufio.NewWriter(file)
+// scanHistoryLines calls line with the offset and the beginning of each line
+// in the first end bytes of file, until it returns false.
+func scanHistoryLines(file *os.File, end int64, line func(offset int64, start []byte) bool) error {
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, end))
+	offset, lineStart := int64(0), true
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(chunk) > 0 && lineStart && !line(offset, chunk) {
+			return nil
+		}
+		offset += int64(len(chunk))
+		// a line longer than the buffer comes in several chunks
+		lineStart = err == nil
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil && err != bufio.ErrBufferFull:
+			return err
+		}
+	}
+}
 
-	defer func() {
-		writer.Flush()
-	}()
+// historyFileFormat tells the format of the history file from its first
+// line, as loading it does.
+func historyFileFormat(file *os.File) string {
+	first, _ := bufio.NewReader(io.NewSectionReader(file, 0, 64*1024)).ReadString('\n')
+	var parser historyParser
+	parser.detect(strings.TrimSuffix(first, "\n"))
+	return parser.format
+}
 
-	lastIndex := h.lastWriteIndex
-	for lastIndex < len(h.commands) {
-		if _, err := writer.WriteString(h.commands[lastIndex]); err != nil {
-			h.lastWriteIndex = lastIndex
-			fmt.Println(err)
-			return
+// historyLimit returns the number of commands the variable name limits the
+// history to, or false when it is not set to a number, for no limit.
+func historyLimit(name string) (int, bool) {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// historyControl reports whether HISTCONTROL, a colon-separated list, has
+// option; ignoreboth stands for ignorespace and ignoredups.
+func historyControl(option string) bool {
+	for _, value := range strings.Split(os.Getenv("HISTCONTROL"), ":") {
+		if value == option || value == "ignoreboth" && (option == "ignorespace" || option == "ignoredups") {
+			return true
 		}
-		if err := writer.WriteByte('\n'); err != nil {
-			h.lastWriteIndex = lastIndex
-			fmt.Println(err)
-			return
+	}
+	return false
+}
+
+// ignoredByHistory reports whether command is left out of the history:
+// with HISTCONTROL, lines starting with a space for ignorespace, and
+// repeats of the previous command for ignoredups; and the commands matching
+// one of the colon-separated patterns of HISTIGNORE, where & stands for the
+// previous command.
+func ignoredByHistory(command string, previous string) bool {
+	if historyControl("ignorespace") && strings.HasPrefix(command, " ") {
+		return true
+	}
+	if historyControl("ignoredups") && command == previous {
+		return true
+	}
+	if ignore := os.Getenv("HISTIGNORE"); ignore != "" {
+		for _, pattern := range strings.Split(ignore, ":") {
+			if pattern == "&" {
+				pattern = escapePattern(previous)
+			}
+			if pattern != "" && MatchPattern(pattern, command) {
+				return true
+			}
 		}
-		lastIndex++
-		h.lastWriteIndex = lastIndex
 	}
+	return false
+}
+
+// formatHistoryEntry returns the line `history` lists entry number n with,
+// with its metadata when verbose is set, or - where it is unknown.
+func formatHistoryEntry(n int, entry HistoryEntry, verbose bool) string {
+	if !verbose {
+		return fmt.Sprintf("    %d  %s\n", n, entry.Command)
+	}
+
+	start, duration, status, dir := "-", "-", "-", "-"
+	if !entry.Start.IsZero() {
+		start = entry.Start.Format(time.DateTime)
+	}
+	if entry.Duration > 0 {
+		duration = entry.Duration.Round(time.Millisecond).String()
+		status = strconv.Itoa(entry.Status)
+	}
+	if entry.Dir != "" {
+		dir = entry.Dir
+	}
+	return fmt.Sprintf("%5d  %-19s  %8s  %3s  %s  %s\n", n, start, duration, status, dir, entry.Command)
 }
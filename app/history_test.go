@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// historyOf returns a history of commands.
+func historyOf(commands ...string) *History {
+	hist := &History{}
+	for _, command := range commands {
+		hist.entries = append(hist.entries, HistoryEntry{Command: command})
+	}
+	return hist
+}
+
+// historyCommands returns the commands of hist.
+func historyCommands(hist *History) []string {
+	var commands []string
+	for _, entry := range hist.entries {
+		commands = append(commands, entry.Command)
+	}
+	return commands
+}
+
+func TestHistoryPrefixNavigation(t *testing.T) {
+
+	hist := historyOf("echo a1", "ls", "echo a2", "echo a2", "pwd")
+
+	tests := []struct {
+		name     string
+		typed    string
+		keys     string
+		expected []string
+	}{
+		{"All Commands", "", "^^^^^", []string{"pwd", "echo a2", "ls", "echo a1", ""}},
+		{"Prefix", "echo", "^^^", []string{"echo a2", "echo a1", ""}},
+		{"Back To The Typed Line", "echo", "^^vvv", []string{"echo a2", "echo a1", "echo a2", "echo", ""}},
+		{"Line Equal To A Command", "ls", "^", []string{""}},
+		{"No Match", "cd", "^v", []string{"", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index := hist.GetHistoryIndex()
+			current := tt.typed
+			for i, key := range tt.keys {
+				var command string
+				var ok bool
+				if key == '^' {
+					command, ok = hist.Prev(&index, tt.typed, current)
+				} else if index < hist.GetHistoryIndex() {
+					command, ok = hist.Next(&index, tt.typed, current)
+					if !ok {
+						command, ok = tt.typed, true
+					}
+				}
+				if !ok {
+					command = ""
+				} else {
+					current = command
+				}
+				if command != tt.expected[i] {
+					t.Errorf("%q: key %d gave %q, expected: %q", tt.keys, i+1, command, tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestExpandHistory(t *testing.T) {
+
+	hist := historyOf(
+		"ls -l /usr/local/lib.tar.gz",
+		"echo 'a b' c",
+		"cat notes.txt",
+	)
+
+	tests := []struct {
+		input    string
+		expected string
+		run      bool
+	}{
+		{"sudo !!", "sudo cat notes.txt", true},
+		{"!1", "ls -l /usr/local/lib.tar.gz", true},
+		{"!-2", "echo 'a b' c", true},
+		{"!ec", "echo 'a b' c", true},
+		{"!?local?", "ls -l /usr/local/lib.tar.gz", true},
+		{"!?note", "cat notes.txt", true},
+		{"vi !$", "vi notes.txt", true},
+		{"!^", "notes.txt", true},
+		{"!-2:1", "'a b'", true},
+		{"!-2:*", "'a b' c", true},
+		{"!-2:0-1", "echo 'a b'", true},
+		{"!-2:1-", "'a b'", true},
+		{"!:0", "cat", true},
+		{"echo !1:2:h !1:$:t !1:$:r !1:$:e", "echo /usr/local lib.tar.gz /usr/local/lib.tar .gz", true},
+		{"!!:s/notes/todo/", "cat todo.txt", true},
+		{"!1:gs/l/L/", "Ls -L /usr/LocaL/Lib.tar.gz", true},
+		{"!!:s/t/[&]/", "ca[t] notes.txt", true},
+		{"^cat^less", "less notes.txt", true},
+		{"^notes^todo^ | wc", "cat todo.txt | wc", true},
+		{"!!:p", "cat notes.txt", false},
+		{"echo '!!' \\!! \"!!\"", "echo '!!' \\!! \"cat notes.txt\"", true},
+		{"echo $! ${!x} [!a]* ! x != y", "echo $! ${!x} [!a]* ! x != y", true},
+		{"echo !#", "echo echo ", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, run, err := expandHistory(tt.input, hist)
+			if err != nil || got != tt.expected || run != tt.run {
+				t.Errorf("expandHistory(%q) = %q, %v, %v, expected: %q, %v", tt.input, got, run, err, tt.expected, tt.run)
+			}
+		})
+	}
+
+	failures := []struct {
+		input    string
+		expected string
+	}{
+		{"!nope", "!nope: event not found"},
+		{"!9", "!9: event not found"},
+		{"!!:5", "5: bad word specifier"},
+		{"!!:s/nope/x/", ":s/nope/x/: substitution failed"},
+		{"!!:z", ":z: unrecognized history modifier"},
+	}
+
+	for _, tt := range failures {
+		t.Run(tt.input, func(t *testing.T) {
+			if _, _, err := expandHistory(tt.input, hist); err == nil || err.Error() != tt.expected {
+				t.Errorf("expandHistory(%q) gave error %v, expected: %q", tt.input, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHistoryAdd(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected []string
+	}{
+		{"Everything", nil, []string{"ls", "ls", " secret", "pwd", "ls", "cd /tmp", "ls"}},
+		{"Size", map[string]string{"HISTSIZE": "2"}, []string{"cd /tmp", "ls"}},
+		{"Ignore Space", map[string]string{"HISTCONTROL": "ignorespace"}, []string{"ls", "ls", "pwd", "ls", "cd /tmp", "ls"}},
+		{"Ignore Dups", map[string]string{"HISTCONTROL": "ignoredups"}, []string{"ls", " secret", "pwd", "ls", "cd /tmp", "ls"}},
+		{"Ignore Both", map[string]string{"HISTCONTROL": "ignoreboth"}, []string{"ls", "pwd", "ls", "cd /tmp", "ls"}},
+		{"Erase Dups", map[string]string{"HISTCONTROL": "ignorespace:erasedups"}, []string{"pwd", "cd /tmp", "ls"}},
+		{"Ignore Patterns", map[string]string{"HISTIGNORE": "ls:cd *: *"}, []string{"pwd"}},
+		{"Ignore The Previous Command", map[string]string{"HISTIGNORE": "&"}, []string{"ls", " secret", "pwd", "ls", "cd /tmp", "ls"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"HISTSIZE", "HISTCONTROL", "HISTIGNORE"} {
+				t.Setenv(name, tt.env[name])
+			}
+			hist := &History{}
+			for _, command := range []string{"ls", "ls", " secret", "pwd", "ls", "cd /tmp", "ls"} {
+				hist.Add(command)
+			}
+			if commands := historyCommands(hist); !slices.Equal(commands, tt.expected) {
+				t.Errorf("history = %q, expected: %q", commands, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHistoryFileSize(t *testing.T) {
+
+	t.Setenv("HISTSIZE", "3")
+	t.Setenv("HISTFILESIZE", "4")
+	path := filepath.Join(t.TempDir(), "history")
+	if err := os.WriteFile(path, []byte("one\ntwo\nthree\nfour\nfive\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hist := &History{}
+	hist.LoadHistory(path)
+	if expected := []string{"three", "four", "five"}; !slices.Equal(historyCommands(hist), expected) {
+		t.Errorf("loaded %q, expected: %q", historyCommands(hist), expected)
+	}
+
+	hist.lastWriteIndex = len(hist.entries)
+	hist.Add("six")
+	hist.AppendHistory(path)
+	data, _ := os.ReadFile(path)
+	if expected := "three\nfour\nfive\nsix\n"; string(data) != expected {
+		t.Errorf("history file = %q, expected: %q", data, expected)
+	}
+
+	// without HISTFILESIZE, HISTSIZE keeps commands, whatever their lines
+	t.Setenv("HISTFILESIZE", "")
+	os.Unsetenv("HISTFILESIZE")
+	t.Setenv("HISTFORMAT", "extended")
+	t.Setenv("HISTSIZE", "4")
+	hist = historyOf("one", "two", "for f in *\ndo echo $f\ndone", "four", "five")
+	hist.WriteHistory(path)
+	loaded := &History{}
+	loaded.LoadHistory(path)
+	if expected := []string{"two", "for f in *\ndo echo $f\ndone", "four", "five"}; !slices.Equal(historyCommands(loaded), expected) {
+		t.Errorf("loaded %q, expected: %q", historyCommands(loaded), expected)
+	}
+}
+
+func TestHistoryFormats(t *testing.T) {
+
+	start := time.Date(2026, 10, 17, 9, 30, 0, 0, time.Local)
+	entries := []HistoryEntry{
+		{Command: "make test", Start: start, Duration: 1500 * time.Millisecond, Status: 2, Dir: "/src", Session: "s1", Host: "box"},
+		{Command: "for f in *\ndo echo $f\ndone", Start: start.Add(time.Minute), Duration: time.Millisecond, Dir: "/src"},
+		{Command: "ls"},
+	}
+
+	tests := []struct {
+		format   string
+		expected []HistoryEntry
+	}{
+		// plain files only keep the commands, one line each
+		{"plain", []HistoryEntry{{Command: "make test"}, {Command: "for f in *"}, {Command: "do echo $f"}, {Command: "done"}, {Command: "ls"}}},
+		{"extended", []HistoryEntry{{Command: entries[0].Command, Start: start}, {Command: entries[1].Command, Start: start.Add(time.Minute)}, {Command: "ls"}}},
+		{"json", entries},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			t.Setenv("HISTFORMAT", tt.format)
+			path := filepath.Join(t.TempDir(), "history")
+			written := &History{entries: entries}
+			written.WriteHistory(path)
+
+			loaded := &History{}
+			loaded.LoadHistory(path)
+			if len(loaded.entries) != len(tt.expected) {
+				t.Fatalf("loaded %q, expected: %q", historyCommands(loaded), tt.expected)
+			}
+			for i, entry := range loaded.entries {
+				expected := tt.expected[i]
+				if entry.Command != expected.Command || !entry.Start.Equal(expected.Start) || entry.Duration != expected.Duration ||
+					entry.Status != expected.Status || entry.Dir != expected.Dir || entry.Session != expected.Session || entry.Host != expected.Host {
+					t.Errorf("loaded %+v, expected: %+v", entry, expected)
+				}
+			}
+		})
+	}
+
+	// the format of a file is told by its first line only
+	files := []struct {
+		content  string
+		expected []string
+	}{
+		{"ls\n#42\necho a\n{}\npwd\n", []string{"ls", "#42", "echo a", "{}", "pwd"}},
+		{"#1792222200\necho a\n#0\necho b\necho c\n#1\n{}\n", []string{"echo a", "echo b\necho c", "{}"}},
+		{"{\"command\":\"pwd\",\"status\":1}\n#42\n{}\n", []string{"pwd", "#42", "{}"}},
+	}
+	for _, file := range files {
+		path := filepath.Join(t.TempDir(), "history")
+		if err := os.WriteFile(path, []byte(file.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		loaded := &History{}
+		loaded.LoadHistory(path)
+		if !slices.Equal(historyCommands(loaded), file.expected) {
+			t.Errorf("loaded %q from %q, expected: %q", historyCommands(loaded), file.content, file.expected)
+		}
+	}
+}
+
+func TestHistoryBuiltin(t *testing.T) {
+
+	defer func(saved *History) { history = saved }(GetHistory())
+	t.Setenv("HISTFILE", "")
+	start := time.Date(2026, 10, 17, 9, 30, 0, 0, time.Local)
+	entries := []HistoryEntry{
+		{Command: "make", Start: start, Duration: 1500 * time.Millisecond, Status: 2, Dir: "/src"},
+		{Command: "ls", Start: start, Duration: time.Millisecond, Dir: "/tmp"},
+		{Command: "cat notes", Start: start, Duration: time.Millisecond, Status: 1, Dir: "/tmp"},
+		{Command: "echo old"},
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"history 2", "    3  cat notes\n    4  echo old"},
+		{"history -F", "    1  make\n    3  cat notes"},
+		{"history -F 1", "    3  cat notes"},
+		{"history -D /tmp", "    2  ls\n    3  cat notes"},
+		{"history -v -D /src", "    1  2026-10-17 09:30:00      1.5s    2  /src  make"},
+		{"history -v 1", "    4  -                           -    -  -  echo old"},
+		{"history -x 2>/dev/null; echo $?", "2"},
+		{"history two 2>&1; echo $?", "history: two: numeric argument required\n1"},
+		{"history 1 2 2>/dev/null; echo $?", "1"},
+		{"history -c; history; echo $?", "0"},
+		{"history -d 2; history", "    1  make\n    2  cat notes\n    3  echo old"},
+		{"history -d -1; history 1", "    3  cat notes"},
+		{"history -d 2-3; history", "    1  make\n    2  echo old"},
+		{"history -d -3--2; history", "    1  make\n    2  echo old"},
+		{"history -d 5 2>&1; echo $?", "history: 5: history position out of range\n1"},
+		{"history -d 2>/dev/null; echo $?", "2"},
+		{"history -s git commit; history 1", "    5  git commit"},
+		{"history -p '!!' '!m:s/ke/n/' 'x'", "echo old\nman\nx"},
+		{"history -p '!zz' 2>&1; echo $?", "history: !zz: event not found\n1"},
+		{"HISTFILE=; history -a 2>&1; echo $?", "history: HISTFILE is not set\n1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			history = &History{entries: slices.Clone(entries)}
+			if got := CommandSubstitution(tt.input); got != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+
+	t.Run("read new", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "history")
+		t.Setenv("HISTFILE", path)
+		history = &History{}
+		CommandSubstitution("history -s one; history -a")
+		other := &History{}
+		other.Add("two")
+		other.AppendHistory(path)
+		if got := CommandSubstitution("history -n; history"); got != "    1  one\n    2  two" {
+			t.Errorf("history -n read %q, expected the command of the other shell", got)
+		}
+	})
+
+	t.Run("ignored command line", func(t *testing.T) {
+		defer func(saved bool) { interactive = saved }(interactive)
+		interactive = true
+		t.Setenv("HISTCONTROL", "ignorespace")
+		history = historyOf("make")
+		// only the history command that was stored gives its place
+		ExecuteCommand("history -s one")
+		ExecuteCommand(" history -s two")
+		ExecuteCommand("history -s three; history -s four")
+		expected := []string{"make", "one", "two", "three", "four"}
+		if got := historyCommands(history); !slices.Equal(got, expected) {
+			t.Errorf("history holds %q, expected: %q", got, expected)
+		}
+	})
+}
+
+func TestFcBuiltin(t *testing.T) {
+
+	defer func(saved *History) { history = saved }(GetHistory())
+	dir := t.TempDir()
+	t.Setenv("FCEDIT", "")
+
+	tests := []struct {
+		input    string
+		expected string
+		history  []string
+	}{
+		{"fc -l", "1\t echo one\n2\t echo two\n3\t ls " + dir, nil},
+		{"fc -l 2", "2\t echo two\n3\t ls " + dir, nil},
+		{"fc -lnr -3 -2", "\t echo two\n\t echo one", nil},
+		{"fc -l 3 1", "3\t ls " + dir + "\n2\t echo two\n1\t echo one", nil},
+		{"fc -l echo", "2\t echo two\n3\t ls " + dir, nil},
+		{"fc -l 20", "3\t ls " + dir, nil},
+		{"fc -s", "ls " + dir, []string{"echo one", "echo two", "ls " + dir, "ls " + dir}},
+		{"fc -s one=1 1", "echo 1\n1", []string{"echo one", "echo two", "ls " + dir, "echo 1"}},
+		{"fc -e - two=2 echo", "echo 2\n2", nil},
+		{"fc -e true -2", "echo two\ntwo", nil},
+		{"fc -e 'sed -i s/one/uno/' 1 2", "echo uno\necho two\nuno\ntwo", []string{"echo one", "echo two", "ls " + dir, "echo uno\necho two"}},
+		{"fc -e false; echo $?", "1", nil},
+		{"fc -s zz 2>&1; echo $?", "fc: zz: no command found\n1", nil},
+		{"fc -e true 9 2>&1; echo $?", "fc: 9: history specification out of range\n1", nil},
+		{"fc -x 2>/dev/null; echo $?", "2", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			history = historyOf("echo one", "echo two", "ls "+dir)
+			if got := CommandSubstitution(tt.input + " 2>&1"); got != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.input, got, tt.expected)
+			}
+			if tt.history != nil && !slices.Equal(historyCommands(history), tt.history) {
+				t.Errorf("%q left the history %q, expected: %q", tt.input, historyCommands(history), tt.history)
+			}
+		})
+	}
+}
+
+func TestHistorySharing(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "history")
+	t.Setenv("HISTFILE", path)
+	t.Setenv("HISTSIZE", "")
+	t.Setenv("HISTFILESIZE", "")
+	t.Setenv("HISTFORMAT", "")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// two shells started on the same file
+	first, second := &History{}, &History{}
+	for _, hist := range []*History{first, second} {
+		hist.LoadHistory(path)
+		hist.lastWriteIndex = len(hist.entries)
+	}
+
+	t.Setenv("HISTSYNC", "append")
+	first.Add("one")
+	first.AppendHistory(path)
+	if data, _ := os.ReadFile(path); string(data) != "old\none\n" {
+		t.Errorf("history file = %q, expected the command appended", data)
+	}
+
+	t.Setenv("HISTSYNC", "share")
+	second.Add("two")
+	second.AppendHistory(path)
+	if expected := []string{"old", "one", "two"}; !slices.Equal(historyCommands(second), expected) {
+		t.Errorf("second shell history = %q, expected: %q", historyCommands(second), expected)
+	}
+	first.AppendHistory(path)
+	if expected := []string{"old", "one", "two"}; !slices.Equal(historyCommands(first), expected) {
+		t.Errorf("first shell history = %q, expected: %q", historyCommands(first), expected)
+	}
+
+	// the file truncated by the other shell
+	t.Setenv("HISTFILESIZE", "2")
+	second.Add("three")
+	second.AppendHistory(path)
+	first.Add("four")
+	first.AppendHistory(path)
+	if expected := []string{"old", "one", "two", "three", "four"}; !slices.Equal(historyCommands(first), expected) {
+		t.Errorf("first shell history = %q, expected: %q", historyCommands(first), expected)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "three\nfour\n" {
+		t.Errorf("history file = %q, expected its last 2 lines", data)
+	}
+
+	// shells appending at once lose no command
+	t.Setenv("HISTFILESIZE", "")
+	t.Setenv("HISTSYNC", "append")
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			hist := &History{}
+			for j := range 20 {
+				hist.Add(fmt.Sprintf("echo %d %d", i, j))
+				hist.AppendHistory(path)
+			}
+		})
+	}
+	wg.Wait()
+	loaded := &History{}
+	loaded.LoadHistory(path)
+	if len(loaded.entries) != 2+8*20 {
+		t.Errorf("loaded %d commands, expected: %d", len(loaded.entries), 2+8*20)
+	}
+}
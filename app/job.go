@@ -0,0 +1,528 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// jobControl is on in an interactive shell reading from a terminal. The
+// external commands of a pipeline then run in a process group of their own,
+// which has the terminal while it runs in the foreground, so that Ctrl-Z
+// stops it and `fg` and `bg` resume it.
+var jobControl bool
+
+var (
+	// terminalFd is the terminal the shell reads commands from
+	terminalFd int
+	// shellPgid is the process group of the shell, which has the terminal
+	// back whenever no job runs in the foreground
+	shellPgid int
+)
+
+// lastBackgroundPid is `$!`, the process id of the last background job.
+var lastBackgroundPid int
+
+// initJobControl turns job control on for the terminal fd.
+func initJobControl(fd int) {
+	jobControl = true
+	terminalFd = fd
+	shellPgid = unix.Getpgrp()
+	initSignals()
+}
+
+type jobState int
+
+const (
+	jobRunning jobState = iota
+	jobStopped
+	jobDone
+)
+
+// Job is a pipeline that was started in the background with `&` or stopped
+// while running in the foreground.
+type Job struct {
+	id      int
+	pgid    int
+	pids    []int
+	command string
+
+	mu sync.Mutex
+	// waiting counts the commands still running or stopped, and stopped
+	// the processes stopped since the job was last resumed
+	waiting int
+	stopped int
+	status  int
+	// err is the result of the last command
+	err error
+	// changed gets a value whenever the counts change
+	changed chan struct{}
+}
+
+// jobs is the job table, by increasing job id.
+var jobs []*Job
+
+// newJob tracks the commands of a started pipeline. startErrors has the
+// error for each command that could not be started.
+func newJob(command string, pgid int, executables []Executable, startErrors []error) *Job {
+	job := &Job{
+		pgid:    pgid,
+		command: command,
+		waiting: len(executables),
+		changed: make(chan struct{}, 1),
+	}
+	for i, e := range executables {
+		last := i == len(executables)-1
+		if startErrors[i] != nil {
+			job.finish(startErrors[i], last)
+			continue
+		}
+		if external, ok := e.(*ExternalCommand); ok {
+			job.pids = append(job.pids, external.cmd.Process.Pid)
+		}
+		go job.monitor(e, last)
+	}
+	return job
+}
+
+// monitor waits for one command of the job, noting when it stops.
+func (j *Job) monitor(e Executable, last bool) {
+	if external, ok := e.(*ExternalCommand); ok {
+		for waitStopped(external.cmd.Process.Pid) {
+			j.update(func() { j.stopped++ })
+		}
+	}
+	j.finish(e.Wait(), last)
+}
+
+// finish records that a command of the job is done with the result err. The
+// status of the job is the one of its last command.
+func (j *Job) finish(err error, last bool) {
+	j.update(func() {
+		j.waiting--
+		if last {
+			j.status = exitStatusOf(err)
+			j.err = err
+		}
+	})
+}
+
+func (j *Job) update(change func()) {
+	j.mu.Lock()
+	change()
+	j.mu.Unlock()
+
+	select {
+	case j.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (j *Job) state() jobState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch {
+	case j.waiting == 0:
+		return jobDone
+	case j.stopped > 0:
+		return jobStopped
+	}
+	return jobRunning
+}
+
+// wait blocks until the job is done or stopped.
+func (j *Job) wait() {
+	for j.state() == jobRunning {
+		<-j.changed
+	}
+}
+
+// resume continues the processes of a stopped job.
+func (j *Job) resume() {
+	j.update(func() { j.stopped = 0 })
+	if jobControl {
+		syscall.Kill(-j.pgid, syscall.SIGCONT)
+		return
+	}
+	for _, pid := range j.pids {
+		syscall.Kill(pid, syscall.SIGCONT)
+	}
+}
+
+// waitForeground waits for a job that has the terminal until it is done or
+// stopped, and then takes the terminal back. A stopped job goes to the job
+// table, and its status is the one of a command stopped by SIGTSTP.
+func waitForeground(job *Job) int {
+	job.wait()
+	if jobControl {
+		setForeground(shellPgid)
+	}
+
+	if job.state() == jobStopped {
+		if !slices.Contains(jobs, job) {
+			addJob(job)
+		}
+		fmt.Fprintln(os.Stderr)
+		printJob(os.Stderr, job, false)
+		return 128 + int(syscall.SIGTSTP)
+	}
+	removeJob(job)
+	reportSignal(os.Stderr, job.err)
+	return job.status
+}
+
+func addJob(job *Job) {
+	job.id = 1
+	if len(jobs) > 0 {
+		job.id = jobs[len(jobs)-1].id + 1
+	}
+	jobs = append(jobs, job)
+}
+
+func removeJob(job *Job) {
+	jobs = slices.DeleteFunc(jobs, func(j *Job) bool { return j == job })
+}
+
+// executeBackground starts a list in the background. Like a subshell, it
+// must not change the state of the shell, so it runs in a new gosh process.
+func executeBackground(background *Background, streams *Streams) int {
+	jobStreams := *streams
+	if !jobControl {
+		// without job control a background job cannot tell when it may
+		// read from the terminal, so it reads from /dev/null
+		jobStreams.Stdin = nil
+	}
+
+	resourceManager := &ResourceManager{}
+	defer resourceManager.CloseResources()
+	command, err := backgroundCommand(background.body, &jobStreams, resourceManager)
+	if err != nil {
+		fmt.Fprintf(streams.Stderr, "%s: %v\n", shellName, err)
+		return 1
+	}
+	if jobControl {
+		command.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	if err := command.Start(); err != nil {
+		fmt.Fprintf(streams.Stderr, "%s: %v\n", shellName, err)
+		return 1
+	}
+
+	pid := command.cmd.Process.Pid
+	job := newJob(background.body.String(), pid, []Executable{command}, []error{nil})
+	addJob(job)
+	lastBackgroundPid = pid
+	if interactive {
+		fmt.Fprintf(streams.Stderr, "[%d] %d\n", job.id, pid)
+	}
+	return 0
+}
+
+// backgroundCommand returns the command running body in the background: the
+// program itself when body is a simple command running one, so that `$!`
+// and `kill` reach it, and a new gosh process otherwise.
+func backgroundCommand(body SyntaxNode, streams *Streams, r *ResourceManager) (*ExternalCommand, error) {
+	if command := expandExternal(body); command != nil {
+		executable, err := CreateExecutable(command, r, streams)
+		if err != nil {
+			return nil, err
+		}
+		return executable.(*ExternalCommand), nil
+	}
+
+	command, err := NewShellProcess(body.String(), positionalParams)
+	if err != nil {
+		return nil, err
+	}
+	if err := SetIO(nil, command, streams, r); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// NewShellProcess returns a command running body in a new gosh process,
+// with args as its positional parameters. Since a Go program cannot fork,
+// this is how commands that must not change the state of the shell, or
+// share it with others running at the same time, get a copy of it.
+func NewShellProcess(body string, args []string) (*ExternalCommand, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	command := NewExternalCommand(path, append([]string{"-c", shellScript(body), scriptName}, args...)...)
+	command.cmd.Args[0] = shellName
+	return command, nil
+}
+
+// shellScript is the script run by a new gosh process: the definitions of
+// the functions and the options that are set, followed by body.
+func shellScript(body string) string {
+	var script strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(functions)) {
+		fmt.Fprintf(&script, "%s\n", functions[name])
+	}
+	for _, name := range slices.Sorted(maps.Keys(shellOptions)) {
+		if shellOptions[name] {
+			fmt.Fprintf(&script, "set -o %s\n", name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(globOptions)) {
+		if globOptions[name] {
+			fmt.Fprintf(&script, "shopt -s %s\n", name)
+		}
+	}
+	script.WriteString(body)
+	return script.String()
+}
+
+// reportJobs prints and forgets the jobs that are done, before the prompt.
+func reportJobs(w io.Writer) {
+	for _, job := range slices.Clone(jobs) {
+		if job.state() == jobDone {
+			printJob(w, job, false)
+			removeJob(job)
+		}
+	}
+}
+
+// printJob prints a job the way `jobs` lists it, with its process id when
+// long is set.
+func printJob(w io.Writer, job *Job, long bool) {
+	marker := ' '
+	switch index := slices.Index(jobs, job); {
+	case index == len(jobs)-1:
+		marker = '+'
+	case index == len(jobs)-2:
+		marker = '-'
+	}
+
+	var state, command string
+	switch job.state() {
+	case jobRunning:
+		state, command = "Running", job.command+" &"
+	case jobStopped:
+		state, command = "Stopped", job.command
+	case jobDone:
+		state, command = "Done", job.command
+		if sig, ok := signalOf(job.err); ok {
+			state = fmt.Sprintf("Terminated by signal %d", int(sig))
+		} else if job.status != 0 {
+			state = fmt.Sprintf("Exit %d", job.status)
+		}
+	}
+
+	if long {
+		fmt.Fprintf(w, "[%d]%c %d %-24s%s\n", job.id, marker, job.pgid, state, command)
+	} else {
+		fmt.Fprintf(w, "[%d]%c  %-24s%s\n", job.id, marker, state, command)
+	}
+}
+
+// findJob returns the job named by a job spec: `%n` for job n, `%%`, `%+`
+// or `%` for the current job, `%-` for the previous one and `%prefix` for
+// the job whose command starts with prefix. An empty spec is the current
+// job.
+func findJob(spec string) (*Job, error) {
+	if spec == "" {
+		spec = "%+"
+	}
+	name, ok := strings.CutPrefix(spec, "%")
+	if !ok {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+
+	var job *Job
+	switch {
+	case name == "" || name == "%" || name == "+":
+		if len(jobs) > 0 {
+			job = jobs[len(jobs)-1]
+		}
+	case name == "-":
+		if len(jobs) > 1 {
+			job = jobs[len(jobs)-2]
+		}
+	default:
+		if id, err := strconv.Atoi(name); err == nil {
+			for _, j := range jobs {
+				if j.id == id {
+					job = j
+				}
+			}
+			break
+		}
+		for _, j := range jobs {
+			if strings.HasPrefix(j.command, name) {
+				job = j
+			}
+		}
+	}
+
+	if job == nil {
+		if name == "" || name == "%" || name == "+" || name == "-" {
+			return nil, errors.New("current: no such job")
+		}
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	return job, nil
+}
+
+// jobWithPid returns the job one of whose processes is pid.
+func jobWithPid(pid int) (*Job, error) {
+	for _, job := range jobs {
+		if slices.Contains(job.pids, pid) {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("pid %d is not a child of this shell", pid)
+}
+
+// jobsBuiltin lists the jobs, with their process ids with -l and only the
+// process ids with -p.
+func jobsBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	long, pidsOnly := false, false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-l":
+			long = true
+		case "-p":
+			pidsOnly = true
+		default:
+			fmt.Fprintf(stderr, "jobs: %s: invalid option\n", args[0])
+			return ExitStatus(2)
+		}
+		args = args[1:]
+	}
+
+	selected := jobs
+	if len(args) > 0 {
+		selected = nil
+		for _, spec := range args {
+			job, err := findJob(spec)
+			if err != nil {
+				fmt.Fprintf(stderr, "jobs: %v\n", err)
+				return ExitStatus(1)
+			}
+			selected = append(selected, job)
+		}
+	}
+
+	for _, job := range selected {
+		if pidsOnly {
+			fmt.Fprintln(stdout, job.pgid)
+			continue
+		}
+		printJob(stdout, job, long)
+		if job.state() == jobDone {
+			removeJob(job)
+		}
+	}
+	return nil
+}
+
+// fgBuiltin resumes a job in the foreground and waits for it.
+func fgBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if !jobControl {
+		fmt.Fprintln(stderr, "fg: no job control")
+		return ExitStatus(1)
+	}
+	job, err := findJob(strings.Join(args, " "))
+	if err != nil {
+		fmt.Fprintf(stderr, "fg: %v\n", err)
+		return ExitStatus(1)
+	}
+
+	fmt.Fprintln(stdout, job.command)
+	setForeground(job.pgid)
+	job.resume()
+	if status := waitForeground(job); status != 0 {
+		return ExitStatus(status)
+	}
+	return nil
+}
+
+// bgBuiltin resumes a stopped job in the background.
+func bgBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if !jobControl {
+		fmt.Fprintln(stderr, "bg: no job control")
+		return ExitStatus(1)
+	}
+	job, err := findJob(strings.Join(args, " "))
+	if err != nil {
+		fmt.Fprintf(stderr, "bg: %v\n", err)
+		return ExitStatus(1)
+	}
+
+	job.resume()
+	fmt.Fprintf(stdout, "[%d] %s &\n", job.id, job.command)
+	return nil
+}
+
+// disownBuiltin removes jobs from the job table, leaving them running.
+func disownBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	for _, spec := range args {
+		job, err := findJob(spec)
+		if err != nil {
+			fmt.Fprintf(stderr, "disown: %v\n", err)
+			return ExitStatus(1)
+		}
+		removeJob(job)
+	}
+	return nil
+}
+
+// waitBuiltin waits for the given jobs or process ids, or for all the
+// running jobs, and returns the status of the last one it waited for.
+func waitBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if len(args) == 0 {
+		for _, job := range slices.Clone(jobs) {
+			if job.state() == jobRunning {
+				job.wait()
+			}
+			if job.state() == jobDone {
+				removeJob(job)
+			}
+		}
+		return nil
+	}
+
+	status := 0
+	for _, spec := range args {
+		var job *Job
+		var err error
+		if pid, convErr := strconv.Atoi(spec); convErr == nil {
+			job, err = jobWithPid(pid)
+		} else {
+			job, err = findJob(spec)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "wait: %v\n", err)
+			status = 127
+			continue
+		}
+
+		job.wait()
+		status = job.status
+		if job.state() == jobDone {
+			removeJob(job)
+		} else {
+			status = 128 + int(syscall.SIGTSTP)
+		}
+	}
+	if status != 0 {
+		return ExitStatus(status)
+	}
+	return nil
+}
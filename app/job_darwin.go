@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setForeground gives the terminal to the process group pgid. SIGTTOU, which
+// a process changing it from the background gets, is ignored meanwhile since
+// the shell is in the background when it takes the terminal back.
+func setForeground(pgid int) {
+	signal.Ignore(syscall.SIGTTOU)
+	defer catchShellSignal(syscall.SIGTTOU)
+
+	unix.IoctlSetPointerInt(terminalFd, unix.TIOCSPGRP, pgid)
+}
+
+// reapedProcesses holds the wait status of the processes that waitStopped
+// saw exit, by pid, for waitProcess to report.
+var reapedProcesses sync.Map
+
+// waitStopped blocks until the process pid exits or stops, and reports
+// whether it stopped. Without waitid, a process that exited is reaped here,
+// and its status kept for waitProcess.
+func waitStopped(pid int) bool {
+	var status syscall.WaitStatus
+	_, err := syscall.Wait4(pid, &status, syscall.WUNTRACED, nil)
+	for err == syscall.EINTR {
+		_, err = syscall.Wait4(pid, &status, syscall.WUNTRACED, nil)
+	}
+	if err != nil {
+		return false
+	}
+	if status.Stopped() {
+		return true
+	}
+	reapedProcesses.Store(pid, status)
+	return false
+}
+
+// waitProcess waits for the command cmd started. exec.Cmd.Wait still waits
+// for the copying of its input and output when waitStopped already reaped
+// the process, but then fails, so the status kept is reported instead.
+func waitProcess(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	reaped, ok := reapedProcesses.LoadAndDelete(cmd.Process.Pid)
+	if !ok {
+		return err
+	}
+	status := reaped.(syscall.WaitStatus)
+	switch {
+	case status.Signaled():
+		return reapedError{status}
+	case status.ExitStatus() != 0:
+		return ExitStatus(status.ExitStatus())
+	}
+	return nil
+}
+
+// reapedError is the error of a process killed by a signal, reaped by
+// waitStopped.
+type reapedError struct {
+	status syscall.WaitStatus
+}
+
+func (e reapedError) Error() string {
+	return "signal: " + e.status.Signal().String()
+}
+
+func (e reapedError) Sys() any {
+	return e.status
+}
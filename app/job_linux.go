@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// cldStopped is the si_code of a child that was stopped by a signal.
+const cldStopped = 5
+
+// setForeground gives the terminal to the process group pgid. SIGTTOU, which
+// a process changing it from the background gets, is blocked meanwhile since
+// the shell is in the background when it takes the terminal back.
+func setForeground(pgid int) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var mask, old unix.Sigset_t
+	mask.Val[0] = 1 << (unix.SIGTTOU - 1)
+	unix.PthreadSigmask(unix.SIG_BLOCK, &mask, &old)
+	defer unix.PthreadSigmask(unix.SIG_SETMASK, &old, nil)
+
+	unix.IoctlSetPointerInt(terminalFd, unix.TIOCSPGRP, pgid)
+}
+
+// waitStopped blocks until the process pid exits or stops, and reports
+// whether it stopped. A process that exited is left for exec.Cmd.Wait to
+// reap.
+func waitStopped(pid int) bool {
+	var info unix.Siginfo
+	err := unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WSTOPPED|unix.WNOWAIT, nil)
+	for err == unix.EINTR {
+		err = unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WSTOPPED|unix.WNOWAIT, nil)
+	}
+	if err != nil || info.Code != cldStopped {
+		return false
+	}
+
+	// WNOWAIT left the stop to be reported again
+	unix.Waitid(unix.P_PID, pid, &info, unix.WSTOPPED|unix.WNOHANG, nil)
+	return true
+}
+
+// waitProcess waits for the command cmd started.
+func waitProcess(cmd *exec.Cmd) error {
+	return cmd.Wait()
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"maps"
 	"os"
 	"slices"
@@ -13,24 +15,49 @@ import (
 
 var (
 	ShellBuiltinCommands = map[string]bool{
-		"type":    true,
-		"exit":    true,
-		"pwd":     true,
-		"cd":      true,
-		"echo":    true,
-		"history": true,
+		"type":     true,
+		"exit":     true,
+		"pwd":      true,
+		"cd":       true,
+		"echo":     true,
+		"break":    true,
+		"continue": true,
+		"local":    true,
+		"return":   true,
+		"shift":    true,
+		"shopt":    true,
+		"set":      true,
+		"trap":     true,
+		"jobs":     true,
+		"fg":       true,
+		"bg":       true,
+		"disown":   true,
+		"wait":     true,
+		"history":  true,
+		"fc":       true,
+		"complete": true,
+		"compgen":  true,
 	}
 	bell = "\x07"
+
+	// interactive is set when gosh reads commands from a terminal with the REPL
+	interactive bool
 )
 
 func main() {
 
+	terminalFd := int(os.Stdin.Fd())
+	if status, ok := runArgs(os.Args[1:], term.IsTerminal(terminalFd)); ok {
+		exitShell(status)
+	}
+	interactive = true
+	initJobControl(terminalFd)
+
 	if err := loadShellRC(); err != nil {
 		fmt.Println("Unable to open .shellrc")
 		os.Exit(1)
 	}
 
-	terminalFd := int(os.Stdin.Fd())
 	oldState, err := term.MakeRaw(terminalFd)
 	if err != nil {
 		panic(err)
@@ -47,135 +74,171 @@ func main() {
 	repl(prompt, terminalFd, oldState)
 }
 
-func repl(prompt string, terminalFd int, oldState *term.State) {
+func repl(primaryPrompt string, terminalFd int, oldState *term.State) {
 	trie := NewTrie()
 	keys := slices.Collect(maps.Keys(ShellBuiltinCommands))
 	trie.InsertAll(keys...)
-	var command strings.Builder
+	line := newLineEditor(os.Stdout)
+	line.width = func() int {
+		width, _, err := term.GetSize(terminalFd)
+		if err != nil {
+			return 0
+		}
+		return width
+	}
 
+	// pending holds the lines of a command that is not complete yet, like an
+	// open `if`, while the continuation prompt asks for more
+	prompt := primaryPrompt
+	var pending string
+
+	line.prompt = prompt
 	fmt.Print(prompt) // Print prompt once at start
 
 	reader := bufio.NewReader(os.Stdin)
-	var previousTypedCharacter byte
+	var previousKey int
 
 	hist := GetHistory()
 	histIndex := hist.GetHistoryIndex()
+	// typed is the line as it was before moving back in the history, whose
+	// commands Up and Down go through when they start with it
+	var typed string
 
 	for {
-		currentTypedCharacter, _ := reader.ReadByte()
+		key, err := readKey(reader)
+		if err == nil && (key == keyCtrlR || key == keyCtrlS) {
+			// the key that ends the search is handled below
+			key, err = line.searchHistory(hist, reader, &histIndex, key == keyCtrlS)
+			typed = ""
+		}
+		if err != nil {
+			fmt.Print("\r\n")
+			term.Restore(terminalFd, oldState)
+			exitShell(lastExitStatus)
+		}
 
-		switch currentTypedCharacter {
+		switch key {
 		// handling Ctrl + c
-		case 3:
-			fmt.Print("\r\n")
-			command.Reset()
+		case keyCtrlC:
+			line.finish()
+			line.reset()
+			histIndex = hist.GetHistoryIndex()
+			pending = ""
+			prompt = primaryPrompt
+			line.prompt = prompt
 			fmt.Print(prompt)
-		// handling Ctrl + d
-		case 4:
+		// Ctrl + \ and Ctrl + z only signal the pipeline running in the
+		// foreground, and there is none at the prompt
+		case 28, 26:
+		// handling Ctrl + d, which deletes the character under the cursor
+		// unless the line is empty
+		case keyCtrlD:
+			if len(line.buf) > 0 {
+				line.edit(keyDelete)
+				break
+			}
 			fmt.Print("\r\n")
-			if path, ok := os.LookupEnv("HISTFILE"); ok {
-				history.AppendHistory(path)
+			term.Restore(terminalFd, oldState)
+			exitShell(lastExitStatus)
+		// history
+		case keyUp:
+			if histIndex >= hist.GetHistoryIndex() {
+				typed = line.String()
 			}
-			return
-		// Arrow
-		case 27:
-
-			nextCharacter1, _ := reader.ReadByte()
-			nextCharacter2, _ := reader.ReadByte()
-
-			if nextCharacter1 == 91 {
-
-				switch nextCharacter2 {
-				case 'A':
-					cmd := hist.Prev(&histIndex)
-					command.Reset()
-					command.WriteString(cmd)
-					fmt.Print("\r\033[K")
-					fmt.Printf("%s%s", prompt, command.String())
-				case 'B':
-					cmd := hist.Next(&histIndex)
-					command.Reset()
-					command.WriteString(cmd)
-					fmt.Print("\r\033[K")
-					fmt.Printf("%s%s", prompt, command.String())
-				}
+			if command, ok := hist.Prev(&histIndex, typed, line.String()); ok {
+				line.set(command)
+			} else {
+				fmt.Print(bell)
+			}
+		case keyDown:
+			if histIndex >= hist.GetHistoryIndex() {
+				fmt.Print(bell)
+			} else if command, ok := hist.Next(&histIndex, typed, line.String()); ok {
+				line.set(command)
+			} else {
+				line.set(typed)
 			}
 		// Handling tab
 		case '\t':
 
-			commandPrefix := command.String()
-			builtins := trie.SearchAll(commandPrefix)
-			executables := SearchAllExecutable(commandPrefix)
-
-			var combined []string
-			AddItems(&combined, &builtins)
-			AddItems(&combined, &executables)
-
-			switch len(combined) {
+			completed := completeWord(line.buf, line.pos, trie)
+			switch len(completed.matches) {
 			case 0:
 				fmt.Print(bell)
 			case 1:
-				fmt.Print("\r")
-				command.Reset()
-				command.WriteString(fmt.Sprintf("%s ", combined[0]))
-				fmt.Printf("%s%s", prompt, command.String())
+				line.replace(completed.start, completed.text)
 			default:
-
-				slices.Sort(combined)
-				t := NewTrie()
-				t.InsertAll(combined...)
-
-				if t.LongestCommonPrefix() == command.String() {
-					if previousTypedCharacter != '\t' {
-						fmt.Print(bell)
-					} else {
-						fmt.Print("\r")
-						fmt.Printf("%s%s", prompt, command.String())
-						fmt.Printf("\r\n%s", strings.Join(combined, "  "))
-						fmt.Printf("\r\n%s%s", prompt, t.LongestCommonPrefix())
-					}
-				} else {
-					fmt.Printf("\r%s%s", prompt, t.LongestCommonPrefix())
-					command.Reset()
-					command.WriteString(t.LongestCommonPrefix())
-					previousTypedCharacter = '\n'
+				if completed.text != string(line.buf[completed.start:line.pos]) {
+					line.replace(completed.start, completed.text)
+					previousKey = '\n'
 					continue
 				}
-
+				if previousKey != '\t' {
+					fmt.Print(bell)
+				} else {
+					line.finish()
+					fmt.Printf("%s\r\n", strings.Join(completed.matches, "  "))
+					line.refresh()
+				}
 			}
 		// Handling Enter
 		case '\n', '\r':
-			fmt.Print("\r\n")
-			if command.Len() > 0 {
+			line.finish()
+			histIndex = hist.GetHistoryIndex()
+			if len(line.buf) > 0 || pending != "" {
+				commandInput := pending + line.String()
+				line.reset()
+				if NeedsMoreInput(commandInput) {
+					pending = commandInput + "\n"
+					prompt = continuationPrompt()
+					line.prompt = prompt
+					fmt.Print(prompt)
+					break
+				}
+				pending = ""
+				prompt = primaryPrompt
+				line.prompt = prompt
+
 				// We want commands to run in cooked mode ( Normal ) for proper output formatting
 				if err := term.Restore(terminalFd, oldState); err != nil {
 					return
 				}
 				// StartCommandExecution(command.String())
-				commandInput := command.String()
-				hist.Add(commandInput)
 				ExecuteCommand(commandInput)
+				SyncHistory()
 				histIndex = hist.GetHistoryIndex()
-				command.Reset()
 				// Again making it RAW mode for the next input handling
 				if _, err := term.MakeRaw(terminalFd); err != nil {
 					return
 				}
 			}
+			reportJobs(rawModeWriter{os.Stdout})
 			fmt.Print(prompt)
-		// Handling BackSpace and Del
-		case 127, 8:
-			if command.Len() > 0 {
-				s := command.String()
-				command.Reset()
-				command.WriteString(s[:len(s)-1])
-				fmt.Print("\033[D\033[K")
-			}
 
 		default:
-			command.WriteByte(currentTypedCharacter)
-			fmt.Print(string(currentTypedCharacter))
+			line.edit(key)
 		}
-		previousTypedCharacter = currentTypedCharacter
+		previousKey = key
+	}
+}
+
+// rawModeWriter writes to the terminal while it is in raw mode, where a
+// newline needs a carriage return to start the next line.
+type rawModeWriter struct {
+	io.Writer
+}
+
+func (w rawModeWriter) Write(p []byte) (int, error) {
+	if _, err := w.Writer.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// continuationPrompt is shown while a command spans several lines.
+func continuationPrompt() string {
+	if ps2, ok := os.LookupEnv("PS2"); ok {
+		return ps2
 	}
+	return "> "
 }
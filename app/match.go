@@ -0,0 +1,96 @@
+package main
+
+// MatchPattern reports whether name matches the shell pattern. Unlike
+// filepath.Match, `*` and `?` also match `/`, which is what parameter
+// expansion and `case` expect.
+func MatchPattern(pattern string, name string) bool {
+	return matchRunes([]rune(pattern), []rune(name))
+}
+
+func matchRunes(pattern []rune, name []rune) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchRunes(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		case '[':
+			if len(name) == 0 {
+				return false
+			}
+			matched, width, ok := matchBracket(pattern, name[0])
+			if ok {
+				if !matched {
+					return false
+				}
+				pattern = pattern[width:]
+				name = name[1:]
+				continue
+			}
+			// an unterminated bracket matches a literal `[`
+			if name[0] != '[' {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchBracket matches r against the bracket expression at the start of
+// pattern. It returns the number of pattern runes used and false if the
+// bracket is not terminated.
+func matchBracket(pattern []rune, r rune) (bool, int, bool) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+
+	matched := false
+	for first := true; i < len(pattern); first = false {
+		if pattern[i] == ']' && !first {
+			return matched != negate, i + 1, true
+		}
+
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+		}
+		if lo <= r && r <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, 0, false
+}
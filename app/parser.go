@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
+	"unicode"
 )
 
 /*
@@ -19,24 +22,39 @@ type runeTokenClass int
 type tokenizerState int
 
 const (
-	spaceRunes            = " \t\r\n"
+	spaceRunes            = " \t\r"
+	newlineRunes          = "\n"
 	nonEscapingQuoteRunes = `'`
 	escapinngQuoteRunes   = `"`
 	escapeRunes           = `\`
 	ioRedirectRunes       = `><`
 	digitRunes            = `0123456789`
 	pipeRunes             = `|`
+	semicolonRunes        = `;`
+	ampersandRunes        = `&`
+	parenRunes            = `()`
+	dollarRunes           = `$`
+	backquoteRunes        = "`"
+	commentRunes          = `#`
+	specialParams         = `?#$!@*-`
 )
 
 const (
 	unknownRuneClass runeTokenClass = iota
 	spaceRuneClass
+	newlineRuneClass
 	nonEscapingQuoteRuneClass
 	escapingQuoteRuneClass
 	escapeRuneClass
 	ioRedirectRuneClass
 	digitRuneClass
 	pipeRuneClass
+	semicolonRuneClass
+	ampersandRuneClass
+	parenRuneClass
+	dollarRuneClass
+	backquoteRuneClass
+	commentRuneClass
 	eofRuneClass
 )
 
@@ -54,46 +72,88 @@ const (
 	wordToken TokenType = iota
 	ioRedirectionToken
 	pipeToken
+	andIfToken
+	orIfToken
+	semicolonToken
+	ampersandToken
+	newlineToken
+	lparenToken
+	rparenToken
+	dsemiToken
 )
 
+// reservedWords are recognized in the position of a command name, and only
+// when written unquoted. `in` is not listed because it is only reserved right
+// after `for NAME` and `case WORD`.
+var reservedWords = map[string]bool{
+	"if": true, "then": true, "elif": true, "else": true, "fi": true,
+	"while": true, "until": true, "for": true, "do": true, "done": true,
+	"case": true, "esac": true, "{": true, "}": true, "!": true,
+	"function": true,
+}
+
 var (
 	specialRune map[string]bool = map[string]bool{
 		escapinngQuoteRunes: true,
 		escapeRunes:         true,
 		`$`:                 true,
+		backquoteRunes:      true,
 	}
 )
 
-type Token struct {
-	value     string
-	tokenType TokenType
-}
+type partKind int
+
+const (
+	literalPart partKind = iota
+	paramPart
+	commandPart
+)
 
-type Redirection struct {
-	fileName   string
-	appendOnly bool
+// wordPart is a piece of a word as it was typed. Literal parts keep the text
+// after quote removal, parameter parts keep the raw expansion (`HOME`,
+// `{HOME:-/}`) and command parts the command line inside `$(...)` or
+// backquotes, all to be expanded at execution time. quoted records whether the
+// part was written inside quotes or escaped, which suppresses word splitting.
+type wordPart struct {
+	kind   partKind
+	value  string
+	quoted bool
 }
 
-func NewRedirection(fileName string) *Redirection {
-	return &Redirection{fileName: fileName}
+type Token struct {
+	value     string
+	tokenType TokenType
+	parts     []wordPart
+	// raw is the token exactly as it appears in the input
+	raw string
+	pos Pos
+	// delimiter and hereDoc are the delimiter word and the body of a `<<`
+	// here-document operator
+	delimiter *Token
+	hereDoc   []wordPart
 }
 
-type Command struct {
-	name         string
-	args         []string
-	redirections map[int]*Redirection
+func NewToken(value string, tokenType TokenType) *Token {
+	return &Token{value: value, tokenType: tokenType}
 }
 
-func New(name string, args []string, redirections map[int]*Redirection) *Command {
-	return &Command{
-		name:         name,
-		args:         args,
-		redirections: redirections,
+// appendLiteral adds r to the literal part at the end of parts, starting a new
+// part when the quoting changes.
+func appendLiteral(parts []wordPart, r rune, quoted bool) []wordPart {
+	if n := len(parts); n > 0 && parts[n-1].kind == literalPart && parts[n-1].quoted == quoted {
+		parts[n-1].value += string(r)
+		return parts
 	}
+	return append(parts, wordPart{kind: literalPart, value: string(r), quoted: quoted})
 }
 
-func NewToken(value string, tokenType TokenType) *Token {
-	return &Token{value: value, tokenType: tokenType}
+// closeQuote makes sure a closed quote leaves a quoted part behind, so that
+// empty quotes still produce an (empty) word after expansion.
+func closeQuote(parts []wordPart) []wordPart {
+	if n := len(parts); n > 0 && parts[n-1].quoted {
+		return parts
+	}
+	return append(parts, wordPart{kind: literalPart, quoted: true})
 }
 
 /*-------------------- [ TokenClassifier ] ----------------------*/
@@ -102,12 +162,31 @@ type TokenClassifier map[rune]runeTokenClass
 func NewDefaultClassifier() TokenClassifier {
 	tc := TokenClassifier{}
 	tc.AddClassifier(spaceRunes, spaceRuneClass)
+	tc.AddClassifier(newlineRunes, newlineRuneClass)
 	tc.AddClassifier(nonEscapingQuoteRunes, nonEscapingQuoteRuneClass)
 	tc.AddClassifier(escapinngQuoteRunes, escapingQuoteRuneClass)
 	tc.AddClassifier(ioRedirectRunes, ioRedirectRuneClass)
 	tc.AddClassifier(digitRunes, digitRuneClass)
 	tc.AddClassifier(pipeRunes, pipeRuneClass)
+	tc.AddClassifier(semicolonRunes, semicolonRuneClass)
+	tc.AddClassifier(ampersandRunes, ampersandRuneClass)
+	tc.AddClassifier(parenRunes, parenRuneClass)
 	tc.AddClassifier(escapeRunes, escapeRuneClass)
+	tc.AddClassifier(dollarRunes, dollarRuneClass)
+	tc.AddClassifier(backquoteRunes, backquoteRuneClass)
+	tc.AddClassifier(commentRunes, commentRuneClass)
+	return tc
+}
+
+// NewWordClassifier only knows about quoting and expansions, so the whole
+// input is read as a single word. It is used for the word inside `${VAR:-word}`.
+func NewWordClassifier() TokenClassifier {
+	tc := TokenClassifier{}
+	tc.AddClassifier(nonEscapingQuoteRunes, nonEscapingQuoteRuneClass)
+	tc.AddClassifier(escapinngQuoteRunes, escapingQuoteRuneClass)
+	tc.AddClassifier(escapeRunes, escapeRuneClass)
+	tc.AddClassifier(dollarRunes, dollarRuneClass)
+	tc.AddClassifier(backquoteRunes, backquoteRuneClass)
 	return tc
 }
 
@@ -127,10 +206,74 @@ func (tc TokenClassifier) ClassifyRune(runeInput rune) runeTokenClass {
 type Tokenizer struct {
 	input      bufio.Reader
 	classifier TokenClassifier
+	// position of the last rune read, and the one before it for unreadRune
+	pos     Pos
+	prevPos Pos
+	// raw collects the runes of the token being scanned
+	raw []rune
+	// hereDocs are the `<<` operators of the current line, whose bodies are
+	// read when the line ends, and hereDocOperator is the last one while it
+	// waits for its delimiter word
+	hereDocs        []*Token
+	hereDocOperator *Token
+	// substitutions counts the command substitutions being scanned, and
+	// substitutionText collects the runes read meanwhile
+	substitutions    int
+	substitutionText []rune
+}
+
+func newTokenizer(s string, classifier TokenClassifier) *Tokenizer {
+	return &Tokenizer{
+		input:      *bufio.NewReader(strings.NewReader(s)),
+		classifier: classifier,
+		pos:        Pos{Line: 1},
+	}
+}
+
+// readRune reads the next rune, keeping track of its position and of the raw
+// text of the current token.
+func (tr *Tokenizer) readRune() (rune, error) {
+	r, _, err := tr.input.ReadRune()
+	if err != nil {
+		return r, err
+	}
+
+	tr.prevPos = tr.pos
+	if r == '\n' {
+		tr.pos = Pos{Line: tr.pos.Line + 1}
+	} else {
+		tr.pos.Col++
+	}
+	tr.raw = append(tr.raw, r)
+	if tr.substitutions > 0 {
+		tr.substitutionText = append(tr.substitutionText, r)
+	}
+	return r, nil
+}
+
+// unreadRune puts back the rune returned by the last readRune.
+func (tr *Tokenizer) unreadRune() {
+	if err := tr.input.UnreadRune(); err != nil {
+		return
+	}
+	tr.pos = tr.prevPos
+	tr.raw = tr.raw[:len(tr.raw)-1]
+	if tr.substitutions > 0 {
+		tr.substitutionText = tr.substitutionText[:len(tr.substitutionText)-1]
+	}
+}
+
+// position returns the position of the next rune to be read.
+func (tr *Tokenizer) position() Pos {
+	return Pos{Line: tr.pos.Line, Col: tr.pos.Col + 1}
+}
+
+func (tr *Tokenizer) syntaxError(pos Pos, incomplete bool, format string, args ...any) *SyntaxError {
+	return &SyntaxError{Pos: pos, Msg: fmt.Sprintf(format, args...), Incomplete: incomplete}
 }
 
 func (tr *Tokenizer) getRuneDetails() (rune, runeTokenClass, error) {
-	currentRune, _, err := tr.input.ReadRune()
+	currentRune, err := tr.readRune()
 	currentRuneType := tr.classifier.ClassifyRune(currentRune)
 
 	if err == io.EOF {
@@ -147,7 +290,51 @@ func (tr *Tokenizer) scan() (*Token, error) {
 	state := startState
 	var prevEscapeRune rune
 	var value []rune
+	var parts []wordPart
 	var tokenType TokenType
+	var start, quoteStart Pos
+	tr.raw = tr.raw[:0]
+
+	token := func(tokenType TokenType) *Token {
+		return &Token{value: string(value), tokenType: tokenType, parts: parts, raw: string(tr.raw), pos: start}
+	}
+
+	operator := func(value string, tokenType TokenType) *Token {
+		return &Token{value: value, tokenType: tokenType, raw: value, pos: start}
+	}
+
+	literal := func(r rune, quoted bool) {
+		value = append(value, r)
+		parts = appendLiteral(parts, r, quoted)
+	}
+
+	dollar := func(quoted bool) error {
+		part, ok, err := tr.scanDollar(quoted)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			literal('$', quoted)
+			return nil
+		}
+		if part.kind == commandPart {
+			value = append(value, []rune("$("+part.value+")")...)
+		} else {
+			value = append(value, []rune("$"+part.value)...)
+		}
+		parts = append(parts, part)
+		return nil
+	}
+
+	backquote := func(quoted bool) error {
+		command, err := tr.scanBackquote(quoted)
+		if err != nil {
+			return err
+		}
+		value = append(value, []rune("`"+command+"`")...)
+		parts = append(parts, wordPart{kind: commandPart, value: command, quoted: quoted})
+		return nil
+	}
 
 	for {
 
@@ -159,23 +346,49 @@ func (tr *Tokenizer) scan() (*Token, error) {
 
 		switch state {
 		case startState:
+			start = tr.pos
 			switch nextRuneType {
 			case eofRuneClass:
 				return nil, io.EOF
 			case spaceRuneClass:
-				{
+				tr.raw = tr.raw[:0]
+			case commentRuneClass:
+				// a `#` starting a word comments out the rest of the line
+				for {
+					r, err := tr.readRune()
+					if err != nil {
+						break
+					}
+					if r == '\n' {
+						tr.unreadRune()
+						break
+					}
+				}
+				tr.raw = tr.raw[:0]
+			case newlineRuneClass:
+				start = tr.prevPos
+				start.Col++
+				newline := operator("\n", newlineToken)
+				if err := tr.readHereDocs(); err != nil {
+					return nil, err
 				}
+				return newline, nil
 			case nonEscapingQuoteRuneClass:
 				state = nonEscapingQuoteState
 				tokenType = wordToken
+				quoteStart = start
 			case escapingQuoteRuneClass:
 				state = escapingQuoteState
 				tokenType = wordToken
+				quoteStart = start
 			case escapeRuneClass:
+				if tr.lineContinuation() {
+					break
+				}
 				state = escapeState
 				tokenType = wordToken
 			case digitRuneClass:
-				value = append(value, nextRune)
+				literal(nextRune, false)
 				_, nextToNextRuneType, _ := tr.getRuneDetails()
 				if nextToNextRuneType == ioRedirectRuneClass {
 					state = ioRedirectState
@@ -184,94 +397,154 @@ func (tr *Tokenizer) scan() (*Token, error) {
 					state = inWordState
 					tokenType = wordToken
 				}
-				tr.input.UnreadRune()
+				tr.unreadRune()
 			case ioRedirectRuneClass:
 				state = ioRedirectState
 				tokenType = ioRedirectionToken
 				value = append(value, nextRune)
 			case pipeRuneClass:
-				return NewToken(string(nextRune), pipeToken), nil
+				if tr.nextRuneIs('|') {
+					return operator("||", orIfToken), nil
+				}
+				return operator("|", pipeToken), nil
+			case semicolonRuneClass:
+				if tr.nextRuneIs(';') {
+					return operator(";;", dsemiToken), nil
+				}
+				return operator(";", semicolonToken), nil
+			case ampersandRuneClass:
+				if tr.nextRuneIs('&') {
+					return operator("&&", andIfToken), nil
+				}
+				if !tr.nextRuneIs('>') {
+					return operator("&", ampersandToken), nil
+				}
+				state = ioRedirectState
+				tokenType = ioRedirectionToken
+				value = append(value, '&', '>')
+			case parenRuneClass:
+				if nextRune == '(' {
+					return operator("(", lparenToken), nil
+				}
+				return operator(")", rparenToken), nil
+			case dollarRuneClass:
+				state = inWordState
+				tokenType = wordToken
+				if err := dollar(false); err != nil {
+					return nil, err
+				}
+			case backquoteRuneClass:
+				state = inWordState
+				tokenType = wordToken
+				if err := backquote(false); err != nil {
+					return nil, err
+				}
 			default:
 				state = inWordState
 				tokenType = wordToken
-				value = append(value, nextRune)
+				literal(nextRune, false)
 			}
 		case inWordState:
 			switch nextRuneType {
 			case eofRuneClass:
-				return NewToken(string(value), tokenType), nil
-			case spaceRuneClass:
-				return NewToken(string(value), tokenType), nil
+				return token(tokenType), nil
 			case nonEscapingQuoteRuneClass:
 				state = nonEscapingQuoteState
+				quoteStart = tr.pos
 			case escapingQuoteRuneClass:
 				state = escapingQuoteState
+				quoteStart = tr.pos
 			case escapeRuneClass:
-				state = escapeState
-			case ioRedirectRuneClass:
-				tr.input.UnreadRune()
-				return NewToken(string(value), tokenType), nil
-			case pipeRuneClass:
-				tr.input.UnreadRune()
-				return NewToken(string(value), tokenType), nil
+				if !tr.lineContinuation() {
+					state = escapeState
+				}
+			case spaceRuneClass, newlineRuneClass, ioRedirectRuneClass, pipeRuneClass,
+				semicolonRuneClass, ampersandRuneClass, parenRuneClass:
+				tr.unreadRune()
+				return token(tokenType), nil
+			case dollarRuneClass:
+				if err := dollar(false); err != nil {
+					return nil, err
+				}
+			case backquoteRuneClass:
+				if err := backquote(false); err != nil {
+					return nil, err
+				}
 			default:
 				tokenType = wordToken
-				value = append(value, nextRune)
+				literal(nextRune, false)
 			}
 
 		case nonEscapingQuoteState:
 			switch nextRuneType {
 			case eofRuneClass:
-				return NewToken(string(value), tokenType), nil
+				return nil, tr.syntaxError(quoteStart, true, "unterminated quote")
 			case nonEscapingQuoteRuneClass:
 				state = inWordState
+				parts = closeQuote(parts)
 			default:
-				value = append(value, nextRune)
+				literal(nextRune, true)
 			}
 		case escapingQuoteState:
 			switch nextRuneType {
 			case eofRuneClass:
-				return nil, fmt.Errorf("EOF after escape character")
+				return nil, tr.syntaxError(quoteStart, true, "unterminated quote")
 			case escapingQuoteRuneClass:
 				state = inWordState
+				parts = closeQuote(parts)
 			case escapeRuneClass:
-				state = quotedEscapingState
-				prevEscapeRune = nextRune
+				if !tr.lineContinuation() {
+					state = quotedEscapingState
+					prevEscapeRune = nextRune
+				}
+			case dollarRuneClass:
+				if err := dollar(true); err != nil {
+					return nil, err
+				}
+			case backquoteRuneClass:
+				if err := backquote(true); err != nil {
+					return nil, err
+				}
 			default:
-				value = append(value, nextRune)
+				literal(nextRune, true)
 			}
 		case escapeState:
 			switch nextRuneType {
 			case eofRuneClass:
-				return nil, fmt.Errorf("EOF after escape character")
+				return nil, tr.syntaxError(tr.pos, true, "unexpected end of input after `\\'")
 			default:
 				state = inWordState
-				value = append(value, nextRune)
+				literal(nextRune, true)
 			}
 		case quotedEscapingState:
 			switch nextRuneType {
 			case eofRuneClass:
-				return nil, fmt.Errorf("EOF found while expecting a closing quote")
+				return nil, tr.syntaxError(quoteStart, true, "unterminated quote")
 			default:
 				state = escapingQuoteState
 				if !specialRune[string(nextRune)] {
-					value = append(value, prevEscapeRune)
+					literal(prevEscapeRune, true)
 				}
-				value = append(value, nextRune)
+				literal(nextRune, true)
 			}
 		case ioRedirectState:
-			switch nextRuneType {
-			case eofRuneClass:
-				return nil, fmt.Errorf("EOF while expecting a io redirection")
-			case ioRedirectRuneClass:
+			switch {
+			case nextRuneType == ioRedirectRuneClass:
 				state = ioRedirectState
 				tokenType = ioRedirectionToken
 				value = append(value, nextRune)
-			case spaceRuneClass:
-				return NewToken(string(value), tokenType), nil
+			case nextRuneType == eofRuneClass:
+				return operator(string(value), tokenType), nil
+			case nextRune == '-' && strings.TrimLeft(string(value), "0123456789") == "<<":
+				return operator(string(value)+"-", tokenType), nil
+			case nextRune == '&' && (strings.TrimLeft(string(value), "0123456789") == "<" ||
+				strings.TrimLeft(string(value), "0123456789") == ">"):
+				return operator(string(value)+"&", tokenType), nil
+			case nextRune == '|' && strings.TrimLeft(string(value), "0123456789") == ">":
+				return operator(string(value)+"|", tokenType), nil
 			default:
-				tr.input.UnreadRune()
-				return NewToken(string(value), tokenType), nil
+				tr.unreadRune()
+				return operator(string(value), tokenType), nil
 			}
 		default:
 			return nil, fmt.Errorf("unexpected state: %v", state)
@@ -281,8 +554,334 @@ func (tr *Tokenizer) scan() (*Token, error) {
 	}
 }
 
+// nextRuneIs consumes the next rune if it is r.
+func (tr *Tokenizer) nextRuneIs(r rune) bool {
+	next, err := tr.readRune()
+	if err != nil {
+		return false
+	}
+	if next != r {
+		tr.unreadRune()
+		return false
+	}
+	return true
+}
+
+// lineContinuation reads the newline following a backslash, which joins the
+// lines around it, and reports whether there was one. Both are dropped. A
+// backslash and newline ending the input still need the next line, so they
+// are left to the escape state to report.
+func (tr *Tokenizer) lineContinuation() bool {
+	if !tr.nextRuneIs('\n') {
+		return false
+	}
+	if _, err := tr.readRune(); err != nil {
+		return false
+	}
+	tr.unreadRune()
+	tr.raw = tr.raw[:len(tr.raw)-2]
+	return true
+}
+
+// scanDollar reads what follows an unescaped `$`. It returns a parameter part
+// holding the raw text of the parameter (`HOME`, `?`, `{HOME:-/}`) or a
+// command part for `$(...)`, and false when the `$` does not start an
+// expansion and should be kept literally.
+func (tr *Tokenizer) scanDollar(quoted bool) (wordPart, bool, error) {
+	nextRune, err := tr.readRune()
+	if err == io.EOF {
+		return wordPart{}, false, nil
+	} else if err != nil {
+		return wordPart{}, false, err
+	}
+
+	param := func(raw string) (wordPart, bool, error) {
+		return wordPart{kind: paramPart, value: raw, quoted: quoted}, true, nil
+	}
+
+	switch {
+	case nextRune == '(':
+		command, err := tr.scanCommandSubstitution()
+		if err != nil {
+			return wordPart{}, false, err
+		}
+		return wordPart{kind: commandPart, value: command, quoted: quoted}, true, nil
+	case nextRune == '{':
+		raw, err := tr.scanBraceParam(quoted)
+		if err != nil {
+			return wordPart{}, false, err
+		}
+		return param(raw)
+	case isNameStart(nextRune):
+		name := []rune{nextRune}
+		for {
+			r, err := tr.readRune()
+			if err != nil {
+				break
+			}
+			if !isNameRune(r) {
+				tr.unreadRune()
+				break
+			}
+			name = append(name, r)
+		}
+		return param(string(name))
+	case strings.ContainsRune(specialParams, nextRune) || unicode.IsDigit(nextRune):
+		return param(string(nextRune))
+	default:
+		tr.unreadRune()
+		return wordPart{}, false, nil
+	}
+}
+
+// scanCommandSubstitution reads up to the `)` matching an already consumed
+// `$(`. The command is tokenized and parsed as it is read, so that the `)`
+// of a case pattern, or one in a comment or quotes, does not end it: the
+// substitution ends at the first `)` after a complete command.
+func (tr *Tokenizer) scanCommandSubstitution() (string, error) {
+	start := Pos{Line: tr.pos.Line, Col: tr.pos.Col - 1}
+
+	// the token being scanned goes on once the command is read, whatever
+	// the kind of text it is part of
+	raw, classifier := slices.Clone(tr.raw), tr.classifier
+	hereDocs, hereDocOperator := tr.hereDocs, tr.hereDocOperator
+	tr.classifier, tr.hereDocs, tr.hereDocOperator = NewDefaultClassifier(), nil, nil
+	begin := len(tr.substitutionText)
+	tr.substitutions++
+	defer func() {
+		tr.raw = append(raw, tr.substitutionText[begin:]...)
+		// an enclosing substitution keeps the text as part of its own
+		tr.substitutions--
+		if tr.substitutions == 0 {
+			tr.substitutionText = tr.substitutionText[:0]
+		}
+		tr.classifier, tr.hereDocs, tr.hereDocOperator = classifier, hereDocs, hereDocOperator
+	}()
+
+	var tokens []*Token
+	for {
+		token, err := tr.Next()
+		if err == io.EOF {
+			return "", tr.syntaxError(start, true, "unexpected end of input while looking for matching `)'")
+		} else if err != nil {
+			return "", err
+		}
+
+		if token.tokenType == rparenToken {
+			p := &parser{tokens: tokens, end: token.pos}
+			_, err := p.parseList()
+			if err == nil && p.peek() != nil {
+				err = p.unexpected(p.peek())
+			}
+			var syntaxError *SyntaxError
+			if err == nil {
+				text := tr.substitutionText[begin:]
+				return string(text[:len(text)-1]), nil
+			} else if !errors.As(err, &syntaxError) || !syntaxError.Incomplete {
+				return "", err
+			}
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+// scanBackquote reads an old style `command` substitution up to the closing
+// backquote. A backslash only escapes `$`, backquote and backslash (and `"`
+// inside double quotes); the escaping backslash is removed.
+func (tr *Tokenizer) scanBackquote(quoted bool) (string, error) {
+	start := tr.pos
+	var command []rune
+
+	for {
+		r, err := tr.readRune()
+		if err == io.EOF {
+			return "", tr.syntaxError(start, true, "unexpected end of input while looking for matching ``'")
+		} else if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '`':
+			return string(command), nil
+		case '\\':
+			next, err := tr.readRune()
+			if err != nil {
+				command = append(command, r)
+				continue
+			}
+			if !strings.ContainsRune("$`\\", next) && !(quoted && next == '"') {
+				command = append(command, r)
+			}
+			r = next
+		}
+		command = append(command, r)
+	}
+}
+
+// scanBraceParam reads up to the `}` matching an already consumed `${`,
+// skipping over quoted text and nested `${...}`.
+func (tr *Tokenizer) scanBraceParam(quoted bool) (string, error) {
+	start := Pos{Line: tr.pos.Line, Col: tr.pos.Col - 1}
+	raw := []rune{'{'}
+	depth := 1
+	var quote rune
+	var prev rune
+
+	for {
+		r, err := tr.readRune()
+		if err == io.EOF {
+			return "", tr.syntaxError(start, true, "unexpected end of input while looking for matching `}'")
+		} else if err != nil {
+			return "", err
+		}
+		raw = append(raw, r)
+
+		switch {
+		case r == '\\' && quote != '\'':
+			if escaped, err := tr.readRune(); err == nil {
+				raw = append(raw, escaped)
+			}
+			r = 0
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' && !quoted, r == '"':
+			quote = r
+		case r == '{' && prev == '$':
+			depth++
+		case r == '}':
+			depth--
+			if depth == 0 {
+				return string(raw), nil
+			}
+		}
+		prev = r
+	}
+}
+
 func (tr *Tokenizer) Next() (*Token, error) {
-	return tr.scan()
+	token, err := tr.scan()
+	if err == io.EOF && len(tr.hereDocs) > 0 {
+		return nil, tr.syntaxError(tr.hereDocs[0].pos, true, "unexpected end of input in here-document")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if tr.hereDocOperator != nil && token.tokenType == wordToken {
+		tr.hereDocOperator.delimiter = token
+		tr.hereDocs = append(tr.hereDocs, tr.hereDocOperator)
+	}
+	tr.hereDocOperator = nil
+	// the operator may follow the descriptor it redirects, as in 3<<EOF
+	if op := strings.TrimLeft(token.value, "0123456789"); token.tokenType == ioRedirectionToken && (op == "<<" || op == "<<-") {
+		tr.hereDocOperator = token
+	}
+	return token, nil
+}
+
+// readHereDocs reads the bodies of the here-documents started on the line
+// that just ended. Each body runs up to a line holding only its delimiter;
+// `<<-` strips leading tabs from the lines first.
+func (tr *Tokenizer) readHereDocs() error {
+	for _, operator := range tr.hereDocs {
+		delimiter := operator.delimiter.value
+		var body strings.Builder
+		for {
+			line, complete := tr.readLine()
+			if strings.HasSuffix(operator.value, "<<-") {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == delimiter {
+				break
+			}
+			if !complete {
+				return tr.syntaxError(operator.pos, true, "unexpected end of input in here-document")
+			}
+			body.WriteString(line + "\n")
+		}
+
+		// quoting any part of the delimiter turns expansions off
+		quoted := false
+		for _, part := range operator.delimiter.parts {
+			quoted = quoted || part.quoted
+		}
+		if quoted {
+			operator.hereDoc = []wordPart{{kind: literalPart, value: body.String(), quoted: true}}
+			continue
+		}
+
+		parts, err := parseHereDoc(body.String())
+		if err != nil {
+			return err
+		}
+		operator.hereDoc = parts
+	}
+	tr.hereDocs = nil
+	return nil
+}
+
+// readLine reads up to the end of the line, which complete reports to have
+// been found.
+func (tr *Tokenizer) readLine() (line string, complete bool) {
+	var runes []rune
+	for {
+		r, err := tr.readRune()
+		if err != nil {
+			return string(runes), false
+		}
+		if r == '\n' {
+			return string(runes), true
+		}
+		runes = append(runes, r)
+	}
+}
+
+// parseHereDoc splits the body of a here-document into parts. Like inside
+// double quotes, `$` and backquotes expand and a backslash only escapes `$`,
+// backquote, backslash and newline, but `"` is an ordinary character.
+func parseHereDoc(body string) ([]wordPart, error) {
+	tr := newTokenizer(body, NewWordClassifier())
+	var parts []wordPart
+	for {
+		r, err := tr.readRune()
+		if err != nil {
+			return parts, nil
+		}
+
+		switch r {
+		case '\\':
+			next, err := tr.readRune()
+			switch {
+			case err != nil:
+				parts = appendLiteral(parts, r, true)
+			case next == '\n':
+			case strings.ContainsRune("$`\\", next):
+				parts = appendLiteral(parts, next, true)
+			default:
+				parts = appendLiteral(parts, r, true)
+				parts = appendLiteral(parts, next, true)
+			}
+		case '$':
+			part, ok, err := tr.scanDollar(true)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				parts = appendLiteral(parts, r, true)
+				continue
+			}
+			parts = append(parts, part)
+		case '`':
+			command, err := tr.scanBackquote(true)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, wordPart{kind: commandPart, value: command, quoted: true})
+		default:
+			parts = appendLiteral(parts, r, true)
+		}
+	}
 }
 
 /*-------------------- [ Lexer ] ----------------------*/
@@ -291,14 +890,19 @@ type Lexer Tokenizer
 func NewLexer(s string) *Lexer {
 
 	//	Debug(Yellow, s)
-	reader := strings.NewReader(s)
-	classifier := NewDefaultClassifier()
+	return (*Lexer)(newTokenizer(s, NewDefaultClassifier()))
+}
 
-	tr := &Tokenizer{
-		input:      *bufio.NewReader(reader),
-		classifier: classifier,
+// parseWord tokenizes s as a single word, keeping spaces and operators
+// literal. Quotes, escapes and `$` keep their meaning.
+func parseWord(s string) ([]wordPart, error) {
+	token, err := newTokenizer(s, NewWordClassifier()).Next()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-	return (*Lexer)(tr)
+	return token.parts, nil
 }
 
 func (lx *Lexer) Next() (string, error) {
@@ -321,7 +925,31 @@ func (lx *Lexer) Parse() (*Token, error) {
 	return (*Tokenizer)(lx).Next()
 }
 
-func Parse(s string) []*Command {
+/*-------------------- [ Parser ] ----------------------*/
+
+// SyntaxError reports where and why the input could not be parsed.
+// Incomplete is set when more input could still make it valid, e.g. an
+// unterminated quote or a trailing `&&`.
+type SyntaxError struct {
+	Pos        Pos
+	Msg        string
+	Incomplete bool
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error: %s at %s", e.Msg, e.Pos)
+}
+
+type parser struct {
+	tokens []*Token
+	index  int
+	// end is the position just past the input
+	end Pos
+}
+
+// Parse builds the syntax tree for s. The tree is nil when s holds no
+// commands.
+func Parse(s string) (SyntaxNode, error) {
 
 	lexer := NewLexer(s)
 	var tokens []*Token
@@ -330,82 +958,632 @@ func Parse(s string) []*Command {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			panic(err)
+			return nil, err
 		}
 		tokens = append(tokens, token)
 	}
-	var commandName string
-	var args []string
-	redirections := make(map[int]*Redirection)
-	var commands []*Command
 
-	position := 0
-	start := true
+	p := &parser{tokens: tokens, end: (*Tokenizer)(lexer).position()}
+	node, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token != nil {
+		return nil, p.unexpected(token)
+	}
+	return node, nil
+}
 
-	for position < len(tokens) {
-		token := tokens[position]
-		if start {
-			commandName = token.value
-			position++
-			start = false
-			continue
+// NeedsMoreInput reports whether s is the beginning of a command that is not
+// complete yet, like an open `if` or an unterminated quote.
+func NeedsMoreInput(s string) bool {
+	_, err := Parse(s)
+	var syntaxError *SyntaxError
+	return errors.As(err, &syntaxError) && syntaxError.Incomplete
+}
+
+func (p *parser) peek() *Token {
+	if p.index < len(p.tokens) {
+		return p.tokens[p.index]
+	}
+	return nil
+}
+
+func (p *parser) next() *Token {
+	token := p.peek()
+	if token != nil {
+		p.index++
+	}
+	return token
+}
+
+func (p *parser) skipNewlines() {
+	for token := p.peek(); token != nil && token.tokenType == newlineToken; token = p.peek() {
+		p.index++
+	}
+}
+
+func (p *parser) unexpected(token *Token) error {
+	if token == nil {
+		return &SyntaxError{Pos: p.end, Msg: "unexpected end of input", Incomplete: true}
+	}
+
+	value := token.raw
+	if token.tokenType == newlineToken {
+		value = "newline"
+	}
+	return &SyntaxError{Pos: token.pos, Msg: fmt.Sprintf("unexpected token `%s'", value)}
+}
+
+// isReserved reports whether the token is the given reserved word. Reserved
+// words are only recognized when written unquoted.
+func (t *Token) isReserved(word string) bool {
+	return t != nil && t.tokenType == wordToken && len(t.parts) == 1 &&
+		t.parts[0].kind == literalPart && !t.parts[0].quoted && t.parts[0].value == word
+}
+
+// reservedWord returns the reserved word the token spells, or "" if it is an
+// ordinary word.
+func (t *Token) reservedWord() string {
+	for word := range reservedWords {
+		if t.isReserved(word) {
+			return word
 		}
+	}
+	return ""
+}
 
-		if token.tokenType == wordToken {
-			args = append(args, token.value)
-			position++
+// expect consumes the reserved word or reports the token found instead.
+func (p *parser) expect(word string) error {
+	if token := p.next(); !token.isReserved(word) {
+		return p.unexpected(token)
+	}
+	return nil
+}
+
+// atListEnd reports whether the next token closes the list being parsed.
+// A closer is either a reserved word, ")" or ";;".
+func (p *parser) atListEnd(closers []string) bool {
+	token := p.peek()
+	if token == nil {
+		return true
+	}
+	for _, closer := range closers {
+		switch {
+		case closer == ")" && token.tokenType == rparenToken,
+			closer == ";;" && token.tokenType == dsemiToken,
+			token.isReserved(closer):
+			return true
+		}
+	}
+	return false
+}
+
+// parseList parses and-or lists separated by `;`, `&` or newlines until the end
+// of input or one of closers.
+func (p *parser) parseList(closers ...string) (SyntaxNode, error) {
+
+	p.skipNewlines()
+	list := &List{}
+	if token := p.peek(); token != nil {
+		list.pos = token.pos
+	}
+
+	for !p.atListEnd(closers) {
+		item, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+
+		// a `&` runs the and-or list in the background and also ends it
+		if token := p.peek(); token != nil && token.tokenType == ampersandToken {
+			p.next()
+			p.skipNewlines()
+			list.items = append(list.items, &Background{pos: item.Position(), body: item})
 			continue
 		}
+		list.items = append(list.items, item)
 
-		if token.tokenType == ioRedirectionToken {
-			var fileName string
-			if position+1 < len(tokens) {
-				fileName = tokens[position+1].value
+		if p.atListEnd(closers) {
+			break
+		}
+		token := p.peek()
+		if token.tokenType != semicolonToken && token.tokenType != newlineToken {
+			return nil, p.unexpected(token)
+		}
+		p.next()
+		p.skipNewlines()
+	}
+
+	switch len(list.items) {
+	case 0:
+		return nil, nil
+	case 1:
+		return list.items[0], nil
+	}
+	return list, nil
+}
+
+func (p *parser) parseAndOr() (SyntaxNode, error) {
+
+	left, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peek()
+		if token == nil || (token.tokenType != andIfToken && token.tokenType != orIfToken) {
+			return left, nil
+		}
+		p.next()
+		p.skipNewlines()
+
+		right, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		left = &AndOr{pos: left.Position(), operator: token.tokenType, left: left, right: right}
+	}
+}
+
+func (p *parser) parsePipeline() (SyntaxNode, error) {
+
+	negated := false
+	bang := p.peek()
+	if bang.isReserved("!") {
+		p.next()
+		negated = true
+	}
+
+	first, err := p.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	commands := []SyntaxNode{first}
+	for token := p.peek(); token != nil && token.tokenType == pipeToken; token = p.peek() {
+		p.next()
+		p.skipNewlines()
+
+		command, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+
+	if negated {
+		return &Pipeline{pos: bang.pos, commands: commands, negated: true}, nil
+	}
+	if len(commands) == 1 {
+		return first, nil
+	}
+	return &Pipeline{pos: first.Position(), commands: commands}, nil
+}
+
+func (p *parser) parseCommand() (SyntaxNode, error) {
+	token := p.peek()
+	switch {
+	case token == nil:
+		return nil, p.unexpected(nil)
+	case token.tokenType == lparenToken:
+		return p.parseSubshell()
+	case token.isReserved("{"):
+		return p.parseBraceGroup()
+	case token.isReserved("if"):
+		return p.parseIf()
+	case token.isReserved("while"), token.isReserved("until"):
+		return p.parseLoop()
+	case token.isReserved("for"):
+		return p.parseFor()
+	case token.isReserved("case"):
+		return p.parseCase()
+	case token.isReserved("function"):
+		p.next()
+		return p.parseFunction(p.next())
+	case token.reservedWord() != "":
+		return nil, p.unexpected(token)
+	case p.atFunctionDefinition():
+		return p.parseFunction(p.next())
+	}
+	return p.parseSimpleCommand()
+}
+
+func (p *parser) parseSimpleCommand() (SyntaxNode, error) {
+
+	command := NewSimpleCommand(p.peek().pos, nil, nil, nil)
+
+loop:
+	for token := p.peek(); token != nil; token = p.peek() {
+		switch token.tokenType {
+		case wordToken:
+			p.next()
+			if len(command.words) == 0 && isAssignment(token) {
+				command.assignments = append(command.assignments, token)
+			} else {
+				command.words = append(command.words, token)
 			}
+		case ioRedirectionToken:
+			redirection, err := p.parseRedirection()
+			if err != nil {
+				return nil, err
+			}
+			command.redirections = append(command.redirections, redirection)
+		default:
+			break loop
+		}
+	}
+
+	if len(command.words) == 0 && len(command.assignments) == 0 && len(command.redirections) == 0 {
+		return nil, p.unexpected(p.peek())
+	}
+	return command, nil
+}
+
+func (p *parser) parseRedirection() (*Redirection, error) {
+
+	token := p.next()
+	target := p.peek()
+	if target == nil || target.tokenType != wordToken {
+		return nil, p.unexpected(target)
+	}
+	p.next()
+
+	op := token.value
+	fd := -1
+	if op[0] >= '0' && op[0] <= '9' {
+		fd = int(op[0] - '0')
+		op = op[1:]
+	}
+
+	switch op {
+	case "<", ">", ">>", ">|", "<>", "<&", ">&", "&>", "&>>", "<<", "<<-", "<<<":
+	default:
+		return nil, &SyntaxError{Pos: token.pos, Msg: fmt.Sprintf("unexpected token `%s'", token.value)}
+	}
+	if fd < 0 {
+		fd = defaultDescriptor(op)
+	}
+
+	return &Redirection{
+		fd:         fd,
+		op:         op,
+		appendOnly: op == ">>" || op == "&>>",
+		target:     target,
+		hereDoc:    token.hereDoc,
+	}, nil
+}
+
+// parseRedirections parses the redirections following a compound command.
+func (p *parser) parseRedirections() ([]*Redirection, error) {
+	var redirections []*Redirection
+	for token := p.peek(); token != nil && token.tokenType == ioRedirectionToken; token = p.peek() {
+		redirection, err := p.parseRedirection()
+		if err != nil {
+			return nil, err
+		}
+		redirections = append(redirections, redirection)
+	}
+	return redirections, nil
+}
+
+func (p *parser) parseSubshell() (SyntaxNode, error) {
+
+	open := p.next()
+	body, err := p.parseList(")")
+	if err != nil {
+		return nil, err
+	}
+
+	token := p.next()
+	if body == nil || token == nil || token.tokenType != rparenToken {
+		return nil, p.unexpected(token)
+	}
+
+	redirections, err := p.parseRedirections()
+	if err != nil {
+		return nil, err
+	}
+	return &Subshell{pos: open.pos, body: body, redirections: redirections}, nil
+}
+
+func (p *parser) parseBraceGroup() (SyntaxNode, error) {
+
+	open := p.next()
+	body, err := p.parseList("}")
+	if err != nil {
+		return nil, err
+	}
+
+	token := p.next()
+	if body == nil || !token.isReserved("}") {
+		return nil, p.unexpected(token)
+	}
 
-			redirectionValue := strings.TrimSpace(token.value)
-			fileDescriptor := -1
-			appendOnly := false
-
-			switch redirectionValue {
-			case "<":
-				fileDescriptor = 0
-				appendOnly = false
-			case ">", "1>":
-				fileDescriptor = 1
-				appendOnly = false
-			case "2>":
-				fileDescriptor = 2
-				appendOnly = false
-			case ">>", "1>>":
-				fileDescriptor = 1
-				appendOnly = true
-			case "2>>":
-				fileDescriptor = 2
-				appendOnly = true
+	redirections, err := p.parseRedirections()
+	if err != nil {
+		return nil, err
+	}
+	return &BraceGroup{pos: open.pos, body: body, redirections: redirections}, nil
+}
+
+func (p *parser) parseIf() (SyntaxNode, error) {
+
+	clause, err := p.parseIfBody()
+	if err != nil {
+		return nil, err
+	}
+
+	clause.redirections, err = p.parseRedirections()
+	if err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// parseIfBody parses an `if` or `elif` up to and including the closing `fi`.
+func (p *parser) parseIfBody() (*IfClause, error) {
+
+	open := p.next()
+	condition, err := p.parseList("then")
+	if err != nil {
+		return nil, err
+	}
+	if condition == nil {
+		return nil, p.unexpected(p.peek())
+	}
+	if err := p.expect("then"); err != nil {
+		return nil, err
+	}
+
+	body, err := p.parseList("elif", "else", "fi")
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, p.unexpected(p.peek())
+	}
+
+	clause := &IfClause{pos: open.pos, condition: condition, body: body}
+	switch token := p.peek(); {
+	case token.isReserved("elif"):
+		clause.elseBody, err = p.parseIfBody()
+		if err != nil {
+			return nil, err
+		}
+		return clause, nil
+	case token.isReserved("else"):
+		p.next()
+		clause.elseBody, err = p.parseList("fi")
+		if err != nil {
+			return nil, err
+		}
+		if clause.elseBody == nil {
+			return nil, p.unexpected(p.peek())
+		}
+	}
+
+	if err := p.expect("fi"); err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+func (p *parser) parseLoop() (SyntaxNode, error) {
+
+	open := p.next()
+	condition, err := p.parseList("do")
+	if err != nil {
+		return nil, err
+	}
+	if condition == nil {
+		return nil, p.unexpected(p.peek())
+	}
+	if err := p.expect("do"); err != nil {
+		return nil, err
+	}
+
+	body, err := p.parseDoneBody()
+	if err != nil {
+		return nil, err
+	}
+
+	redirections, err := p.parseRedirections()
+	if err != nil {
+		return nil, err
+	}
+	return &LoopClause{
+		pos:          open.pos,
+		until:        open.value == "until",
+		condition:    condition,
+		body:         body,
+		redirections: redirections,
+	}, nil
+}
 
+func (p *parser) parseFor() (SyntaxNode, error) {
+
+	open := p.next()
+	name := p.next()
+	if name == nil || name.tokenType != wordToken || len(name.parts) != 1 || name.parts[0].quoted ||
+		!isValidName(name.value) {
+		return nil, p.unexpected(name)
+	}
+
+	clause := &ForClause{pos: open.pos, name: name.value}
+	p.skipNewlines()
+	if p.peek().isReserved("in") {
+		p.next()
+		clause.hasIn = true
+		for token := p.peek(); token != nil && token.tokenType == wordToken; token = p.peek() {
+			clause.words = append(clause.words, p.next())
+		}
+		token := p.next()
+		if token == nil || (token.tokenType != semicolonToken && token.tokenType != newlineToken) {
+			return nil, p.unexpected(token)
+		}
+	} else if token := p.peek(); token != nil && token.tokenType == semicolonToken {
+		p.next()
+	}
+
+	p.skipNewlines()
+	if err := p.expect("do"); err != nil {
+		return nil, err
+	}
+
+	var err error
+	clause.body, err = p.parseDoneBody()
+	if err != nil {
+		return nil, err
+	}
+
+	clause.redirections, err = p.parseRedirections()
+	if err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// parseDoneBody parses the body of a loop after `do`, including the closing
+// `done`.
+func (p *parser) parseDoneBody() (SyntaxNode, error) {
+	body, err := p.parseList("done")
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, p.unexpected(p.peek())
+	}
+	if err := p.expect("done"); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (p *parser) parseCase() (SyntaxNode, error) {
+
+	open := p.next()
+	word := p.next()
+	if word == nil || word.tokenType != wordToken {
+		return nil, p.unexpected(word)
+	}
+
+	p.skipNewlines()
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	p.skipNewlines()
+
+	clause := &CaseClause{pos: open.pos, word: word}
+	for !p.peek().isReserved("esac") {
+		if token := p.peek(); token != nil && token.tokenType == lparenToken {
+			p.next()
+		}
+
+		item := &CaseItem{}
+		for {
+			pattern := p.next()
+			if pattern == nil || pattern.tokenType != wordToken {
+				return nil, p.unexpected(pattern)
 			}
+			item.patterns = append(item.patterns, pattern)
 
-			redirections[fileDescriptor] = &Redirection{fileName: fileName, appendOnly: appendOnly}
-			position += 2
+			token := p.next()
+			if token != nil && token.tokenType == rparenToken {
+				break
+			}
+			if token == nil || token.tokenType != pipeToken {
+				return nil, p.unexpected(token)
+			}
+		}
 
+		var err error
+		item.body, err = p.parseList(";;", "esac")
+		if err != nil {
+			return nil, err
 		}
+		clause.items = append(clause.items, item)
+
+		token := p.peek()
+		if token == nil || token.tokenType != dsemiToken {
+			break
+		}
+		p.next()
+		p.skipNewlines()
+	}
+
+	if err := p.expect("esac"); err != nil {
+		return nil, err
+	}
+
+	redirections, err := p.parseRedirections()
+	if err != nil {
+		return nil, err
+	}
+	clause.redirections = redirections
+	return clause, nil
+}
+
+// atFunctionDefinition reports whether the next tokens are `name()`.
+func (p *parser) atFunctionDefinition() bool {
+	if p.index+2 >= len(p.tokens) {
+		return false
+	}
+	return p.tokens[p.index].tokenType == wordToken &&
+		p.tokens[p.index+1].tokenType == lparenToken &&
+		p.tokens[p.index+2].tokenType == rparenToken
+}
+
+// parseFunction parses a function definition after its name, which is either
+// `name() body` or, following the `function` keyword, `name body`.
+func (p *parser) parseFunction(name *Token) (SyntaxNode, error) {
+
+	if name == nil || name.tokenType != wordToken || len(name.parts) != 1 || name.parts[0].quoted ||
+		name.parts[0].kind != literalPart || strings.Contains(name.value, "=") || name.reservedWord() != "" {
+		return nil, p.unexpected(name)
+	}
 
-		if token.tokenType == pipeToken {
-			commands = append(commands, New(commandName, args, redirections))
-			args = nil
-			redirections = nil
-			position++
-			start = true
+	if token := p.peek(); token != nil && token.tokenType == lparenToken {
+		p.next()
+		if token := p.next(); token == nil || token.tokenType != rparenToken {
+			return nil, p.unexpected(token)
 		}
+	}
+	p.skipNewlines()
+
+	token := p.peek()
+	compound := token != nil && token.tokenType == lparenToken
+	for _, word := range []string{"{", "if", "while", "until", "for", "case"} {
+		compound = compound || token.isReserved(word)
+	}
+	if !compound {
+		return nil, p.unexpected(token)
+	}
 
+	body, err := p.parseCommand()
+	if err != nil {
+		return nil, err
 	}
+	return &FunctionDefinition{pos: name.pos, name: name.value, body: body}, nil
+}
 
-	if !start {
-		commands = append(commands, New(commandName, args, redirections))
+// isAssignment reports whether a word has the form NAME=value with the name
+// written unquoted.
+func isAssignment(token *Token) bool {
+	if len(token.parts) == 0 || token.parts[0].kind != literalPart || token.parts[0].quoted {
+		return false
 	}
+	name, _, found := strings.Cut(token.parts[0].value, "=")
+	return found && isValidName(name)
+}
 
-	return commands
+// splitAssignment splits an assignment word into the variable name and the
+// parts making up its value.
+func splitAssignment(token *Token) (string, []wordPart) {
+	name, rest, _ := strings.Cut(token.parts[0].value, "=")
+	value := []wordPart{{kind: literalPart, value: rest}}
+	return name, append(value, token.parts[1:]...)
 }
 
 func Split(s string) ([]string, error) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -110,12 +111,14 @@ func TestSplitWithEscapeCharacterString(t *testing.T) {
 		`"shell'hello'\\'example"`,
 		`"/tmp/ant/\"f 38\"" "/tmp/ant/\"f\\93\""`,
 		`"/tmp/ant/'f 17'" "/tmp/ant/'f  \39'" "/tmp/ant/'f \16\'"`,
+		"one \\\ntwo th\\\nree \"fo\\\nur\" 'fi\\\nve'",
 	}
 	want := []TestCase{
 		NewTestCase(1, []string{`world      script`}),
 		NewTestCase(1, []string{`shell'hello'\'example`}),
 		NewTestCase(2, []string{`/tmp/ant/"f 38"`, `/tmp/ant/"f\93"`}),
 		NewTestCase(3, []string{`/tmp/ant/'f 17'`, `/tmp/ant/'f  \39'`, `/tmp/ant/'f \16\'`}),
+		NewTestCase(5, []string{"one", "two", "three", "four", "fi\\\nve"}),
 	}
 
 	for tt := range input {
@@ -138,3 +141,158 @@ func TestSplitWithEscapeCharacterString(t *testing.T) {
 	}
 
 }
+
+func TestParse(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Sequential",
+			input:    "echo a;echo   b\n\necho c;",
+			expected: "echo a; echo b; echo c",
+		},
+		{
+			name:     "Conditional",
+			input:    `make&&./run || echo failed|cat`,
+			expected: "make && ./run || echo failed | cat",
+		},
+		{
+			name:     "Redirections",
+			input:    `cat<in >out 2>>"err log"`,
+			expected: `cat <in >out 2>>"err log"`,
+		},
+		{
+			name:     "Descriptor Redirections",
+			input:    `cmd >log 2>&1 3<in 4<>rw 5>&- &>>all >|x 0<y`,
+			expected: `cmd >log 2>&1 3<in 4<>rw 5>&- &>>all >|x <y`,
+		},
+		{
+			name:     "Subshell And Brace Group",
+			input:    "(cd /tmp; ls) && { echo a\necho b; } >out",
+			expected: "(cd /tmp; ls) && { echo a; echo b; } >out",
+		},
+		{
+			name:     "Background",
+			input:    "sleep 1 & a && b &\nc; { d & }; if e & then f & fi",
+			expected: "sleep 1 & a && b & c; { d & }; if e & then f & fi",
+		},
+		{
+			name:     "If Elif Else",
+			input:    "if test -f a\nthen cat a\nelif ! test -d b; then echo b; else\n echo c\nfi",
+			expected: "if test -f a; then cat a; elif ! test -d b; then echo b; else echo c; fi",
+		},
+		{
+			name:     "Loops",
+			input:    "while read l; do echo $l; done <in; until false\ndo break; done",
+			expected: "while read l; do echo $l; done <in; until false; do break; done",
+		},
+		{
+			name:     "For",
+			input:    "for f in *.go \"a b\"\ndo\n  echo $f\ndone",
+			expected: `for f in *.go "a b"; do echo $f; done`,
+		},
+		{
+			name:     "Case",
+			input:    "case $x in\n(a|b) echo ab;;\n*) ;;\nesac",
+			expected: "case $x in a|b) echo ab;; *);; esac",
+		},
+		{
+			name:     "Function Definitions",
+			input:    "greet() {\n  echo hi $1\n}\nfunction cleanup {\n  rm -f tmp\n}\nsub() ( cd / )",
+			expected: "greet() { echo hi $1; }; cleanup() { rm -f tmp; }; sub() (cd /)",
+		},
+		{
+			name:     "Comments",
+			input:    "# setup\necho a#b # trailing\necho '#quoted'",
+			expected: "echo a#b; echo '#quoted'",
+		},
+		{
+			name:     "Here-Documents As Here-Strings",
+			input:    "f() { cat <<EOF | tr a b <<-'E'\nhi $1 \"$(date)\" `pwd`\nEOF\n\t$x\nE\n}",
+			expected: "f() { cat <<<\"hi ${1} \\\"$(date)\\\" $(pwd)\" | tr a b <<<\"\\$x\"; }",
+		},
+		{
+			name:     "Line Continuations",
+			input:    "echo one \\\ntwo \"a\\\nb\" c\\\nd \\\n\\\n| cat",
+			expected: `echo one two "ab" cd | cat`,
+		},
+		{
+			name:     "Case In A Command Substitution",
+			input:    "f() { echo $(case $1 in (a) echo A;; *) echo B;; esac); }",
+			expected: "f() { echo $(case $1 in (a) echo A;; *) echo B;; esac); }",
+		},
+		{
+			name:     "Reserved Words As Arguments",
+			input:    `echo if then done`,
+			expected: `echo if then done`,
+		},
+		{
+			name:     "Reserved Words Only In Command Position",
+			input:    `echo { }`,
+			expected: `echo { }`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := Parse(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := node.String(); got != tt.expected {
+				t.Errorf("Parse(%q) = %q, expected: %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseSyntaxError(t *testing.T) {
+
+	tests := []struct {
+		input      string
+		expected   string
+		incomplete bool
+	}{
+		{`&& echo`, "syntax error: unexpected token `&&' at line 1, col 1", false},
+		{`echo a | | cat`, "syntax error: unexpected token `|' at line 1, col 10", false},
+		{`; ;`, "syntax error: unexpected token `;' at line 1, col 1", false},
+		{`& echo`, "syntax error: unexpected token `&' at line 1, col 1", false},
+		{`echo a & ;`, "syntax error: unexpected token `;' at line 1, col 10", false},
+		{`echo >`, "syntax error: unexpected end of input at line 1, col 7", true},
+		{`echo <>>x`, "syntax error: unexpected token `<>>' at line 1, col 6", false},
+		{`echo a ||`, "syntax error: unexpected end of input at line 1, col 10", true},
+		{`echo 'it is unterminated`, "syntax error: unterminated quote at line 1, col 6", true},
+		{"echo ok\necho \"abc", "syntax error: unterminated quote at line 2, col 6", true},
+		{`{ echo a; `, "syntax error: unexpected end of input at line 1, col 11", true},
+		{`(echo a) b`, "syntax error: unexpected token `b' at line 1, col 10", false},
+		{"cat <<EOF\nbody", "syntax error: unexpected end of input in here-document at line 1, col 5", true},
+		{"cat <<EOF", "syntax error: unexpected end of input in here-document at line 1, col 5", true},
+		{"echo $(case x in", "syntax error: unexpected end of input while looking for matching `)' at line 1, col 6", true},
+		{"echo $(echo a;; )", "syntax error: unexpected token `;;' at line 1, col 14", false},
+		{`f() echo a`, "syntax error: unexpected token `echo' at line 1, col 5", false},
+		{`echo a; fi`, "syntax error: unexpected token `fi' at line 1, col 9", false},
+		{`if true; then fi`, "syntax error: unexpected token `fi' at line 1, col 15", false},
+		{"if true\nthen echo a\n", "syntax error: unexpected end of input at line 3, col 1", true},
+		{"for x in a b\ndo", "syntax error: unexpected end of input at line 2, col 3", true},
+		{`case a in a) echo a;;`, "syntax error: unexpected end of input at line 1, col 22", true},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.input)
+
+		var syntaxError *SyntaxError
+		if !errors.As(err, &syntaxError) {
+			t.Errorf("Parse(%q) error = %v, expected a syntax error", tt.input, err)
+			continue
+		}
+
+		if err.Error() != tt.expected || syntaxError.Incomplete != tt.incomplete {
+			t.Errorf("Parse(%q) error = %q (incomplete: %v), expected: %q (incomplete: %v)",
+				tt.input, err, syntaxError.Incomplete, tt.expected, tt.incomplete)
+		}
+	}
+}
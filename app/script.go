@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// runArgs handles the command line arguments of a non-interactive shell and
+// returns the exit status for it. ok is false when gosh was started without
+// arguments on a terminal and should run the REPL instead.
+func runArgs(args []string, stdinIsTerminal bool) (status int, ok bool) {
+	switch {
+	case len(args) == 0:
+		if stdinIsTerminal {
+			return 0, false
+		}
+		return runScript(os.Stdin), true
+	case args[0] == "-c":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "%s: -c: option requires an argument\n", shellName)
+			return 2, true
+		}
+		if len(args) > 2 {
+			scriptName = args[2]
+			positionalParams = args[3:]
+		}
+		execSimpleCommand(args[1])
+		return runScript(strings.NewReader(args[1])), true
+	case args[0] == "-s":
+		positionalParams = args[1:]
+		return runScript(os.Stdin), true
+	case strings.HasPrefix(args[0], "-") && args[0] != "-":
+		fmt.Fprintf(os.Stderr, "%s: %s: invalid option\n", shellName, args[0])
+		fmt.Fprintf(os.Stderr, "usage: %s [-c command [name [arg ...]] | -s [arg ...] | script [arg ...]]\n", shellName)
+		return 2, true
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s: %v\n", shellName, args[0], errors.Unwrap(err))
+		return 127, true
+	}
+	defer file.Close()
+
+	scriptName = args[0]
+	positionalParams = args[1:]
+	return runScript(file), true
+}
+
+// execSimpleCommand replaces the shell with the program to run when script
+// is a single external command, as other shells do for `sh -c 'cmd args'`.
+// This way a background job is the program itself rather than a gosh
+// process waiting for it. It returns when the command is anything else.
+func execSimpleCommand(script string) {
+	node, err := Parse(script)
+	if err != nil {
+		return
+	}
+	command := expandExternal(node)
+	if command == nil || len(command.redirections) > 0 || len(command.env) > 0 {
+		return
+	}
+	_, path := isExternal(command.name)
+	syscall.Exec(path, append([]string{command.name}, command.args...), os.Environ())
+}
+
+// expandExternal returns node expanded when it is a simple command running
+// an external program, which then needs nothing from the shell, and nil
+// otherwise. Commands whose expansion does something, like a command
+// substitution or `${x:=1}`, are left out, since it would be done again if
+// the command turned out to be a function or builtin run by the shell.
+func expandExternal(node SyntaxNode) *Command {
+	command, ok := node.(*Command)
+	if !ok {
+		return nil
+	}
+	var parts []wordPart
+	for _, token := range append(slices.Clone(command.words), command.assignments...) {
+		parts = append(parts, token.parts...)
+	}
+	for _, redirection := range command.redirections {
+		if redirection.target != nil {
+			parts = append(parts, redirection.target.parts...)
+		}
+		parts = append(parts, redirection.hereDoc...)
+	}
+	for _, part := range parts {
+		if part.kind == commandPart || part.kind == paramPart && strings.ContainsAny(part.value, "=$`") {
+			return nil
+		}
+	}
+
+	expanded, err := command.Expand()
+	if err != nil || functions[expanded.name] != nil || ShellBuiltinCommands[expanded.name] {
+		return nil
+	}
+	if found, _ := isExternal(expanded.name); !found {
+		return nil
+	}
+	return expanded
+}
+
+// runScript reads and runs commands from input until its end, one complete
+// command at a time, so that a script runs up to the point where it has a
+// syntax error, which stops it with status 2.
+func runScript(input io.Reader) int {
+	reader := bufio.NewReader(input)
+	streams := StandardStreams()
+
+	var pending strings.Builder
+	startLine, lines := 1, 0
+	for {
+		line, readErr := reader.ReadString('\n')
+		if line == "" && readErr != nil && pending.Len() == 0 {
+			break
+		}
+		pending.WriteString(line)
+		if line != "" {
+			lines++
+		}
+
+		node, err := Parse(pending.String())
+		var syntaxError *SyntaxError
+		if errors.As(err, &syntaxError) && syntaxError.Incomplete && readErr == nil {
+			continue
+		}
+		pending.Reset()
+
+		if err != nil {
+			if syntaxError != nil {
+				syntaxError.Pos.Line += startLine - 1
+			}
+			fmt.Fprintf(os.Stderr, "%s: %v\n", scriptName, err)
+			return setExitStatus(2)
+		}
+		startLine = lines + 1
+
+		if node != nil {
+			execute(node, streams)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	return lastExitStatus
+}
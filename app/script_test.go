@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestMain lets the test binary stand in for gosh in the background jobs
+// the tests start, which run it again with -c.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "-c" {
+		status, _ := runArgs(os.Args[1:], false)
+		exitShell(status)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRunArgs(t *testing.T) {
+
+	defer func(name string, params []string) {
+		scriptName, positionalParams = name, params
+	}(scriptName, positionalParams)
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected int
+	}{
+		{"Command String", []string{"-c", "true && false"}, 1},
+		{"Name And Arguments", []string{"-c", `test "$0:$#:$2" = "name:2:two"`, "name", "one", "two"}, 0},
+		{"Multi-line Command", []string{"-c", "if true\nthen\n  false\nfi"}, 1},
+		{"Syntax Error Stops The Script", []string{"-c", "true\nfi\ntrue"}, 2},
+		{"Missing Script", []string{"no-such-script.gosh"}, 127},
+		{"Invalid Option", []string{"-z"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, ok := runArgs(tt.args, true)
+			if !ok || status != tt.expected {
+				t.Errorf("runArgs(%q) = %d, %v, expected: %d, true", tt.args, status, ok, tt.expected)
+			}
+		})
+	}
+
+	if _, ok := runArgs(nil, true); ok {
+		t.Errorf("runArgs(nil) on a terminal should start the REPL")
+	}
+}
+
+func TestLineContinuation(t *testing.T) {
+
+	// the script is read a line at a time, joined to the next one when it
+	// ends with a backslash
+	script := "echo one \\\n  two \"three\\\nfour\"\necho fi\\\nve |\\\n cat\n"
+	expected := "one two threefour\nfive\n"
+	output, err := exec.Command(os.Args[0], "-c", script).Output()
+	if err != nil || string(output) != expected {
+		t.Errorf("%q printed %q, %v, expected: %q", script, output, err, expected)
+	}
+}
+
+func TestExitTrap(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		script   string
+		expected string
+	}{
+		{"End Of Script", "trap 'echo bye $?' EXIT; echo hi; false", "hi\nbye 1\n"},
+		{"Exit", "trap 'echo bye $?' EXIT; exit 3; echo unreachable", "bye 3\n"},
+		{"Reset", "trap 'echo bye' EXIT; trap - EXIT; echo hi", "hi\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, _ := exec.Command(os.Args[0], "-c", tt.script).Output()
+			if string(output) != tt.expected {
+				t.Errorf("%q printed %q, expected: %q", tt.script, output, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExpansionErrorExits(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		script   string
+		expected string
+		status   int
+	}{
+		{"Command", "echo ${NOPE:?missing}; echo still running", "", 1},
+		{"Compound Command", "for x in ${NOPE:?missing}; do echo $x; done\necho still running", "", 1},
+		{"Subshell", "(echo ${NOPE:?missing}; echo in subshell); echo after $?", "after 1\n", 0},
+		{"Pipeline Stage", "echo ${NOPE:?missing} | cat; echo after", "after\n", 0},
+		{"Exit Trap", "trap 'echo bye $?' EXIT; echo ${NOPE:?missing}", "bye 1\n", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-c", tt.script)
+			output, _ := cmd.Output()
+			if string(output) != tt.expected || cmd.ProcessState.ExitCode() != tt.status {
+				t.Errorf("%q printed %q with status %d, expected: %q with status %d", tt.script, output, cmd.ProcessState.ExitCode(), tt.expected, tt.status)
+			}
+		})
+	}
+}
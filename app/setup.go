@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"strings"
 )
 
 func loadShellRC() error {
@@ -18,32 +16,14 @@ func loadShellRC() error {
 		path = os.ExpandEnv("$HOME/.goshrc")
 	}
 
-	file, err := os.Open(path)
+	content, err := os.ReadFile(path)
 	if err != nil {
 		fmt.Printf("Unable to open %s, please check whether %s exists or not.\n", path, path)
 		return err
 	}
 
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-
-	for scanner.Scan() {
-
-		line := strings.TrimSpace(scanner.Text())
-
-		if "" == line || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) == 2 {
-			key := parts[0]
-			value := strings.Trim(parts[1], "'\"")
-			os.Setenv(key, value)
-		}
-
-	}
-
+	// the file is a shell script, so besides variables it can define
+	// functions
+	executeLine(string(content), StandardStreams())
 	return nil
 }
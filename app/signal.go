@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// interrupted is set when the interactive shell gets SIGINT from Ctrl-C, or
+// when the foreground pipeline is killed by it. The executor then stops
+// running the current command line, like it does for `exit`.
+var interrupted atomic.Bool
+
+var (
+	// shellSignals and interrupts get the signals the interactive shell
+	// catches for itself
+	shellSignals = make(chan os.Signal, 1)
+	interrupts   = make(chan os.Signal, 1)
+)
+
+// initSignals makes the interactive shell survive the signals the terminal
+// sends on Ctrl-C, Ctrl-\ and Ctrl-Z, which are meant for the foreground
+// pipeline, and the ones it gets for using the terminal while a job has it.
+// The signals are caught rather than ignored so that the commands the shell
+// runs get their default behaviour back.
+func initSignals() {
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU} {
+		catchShellSignal(sig)
+	}
+	go func() {
+		for range interrupts {
+			interrupted.Store(true)
+		}
+	}()
+}
+
+// catchShellSignal has the interactive shell catch sig for itself.
+func catchShellSignal(sig syscall.Signal) {
+	switch sig {
+	case syscall.SIGINT:
+		signal.Notify(interrupts, sig)
+	case syscall.SIGQUIT, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+		signal.Notify(shellSignals, sig)
+	}
+}
+
+// checkInterrupt turns a pending interrupt into flow that stops the
+// executor, and reports whether there is one.
+func checkInterrupt() bool {
+	// with a trap on INT, the trap runs instead
+	if _, trapped := traps["INT"]; interrupted.Swap(false) && !trapped {
+		pendingFlow = flowInterrupt
+	}
+	return pendingFlow == flowInterrupt
+}
+
+// signalOf returns the signal that killed the command that err is the
+// result of.
+func signalOf(err error) (syscall.Signal, bool) {
+	// an exec.ExitError, or the error of a process reaped by waitStopped
+	var exitErr interface{ Sys() any }
+	if !errors.As(err, &exitErr) {
+		return 0, false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return 0, false
+	}
+	return status.Signal(), true
+}
+
+// reportSignal tells when the last command of a pipeline was killed by a
+// signal, except by SIGPIPE, which commands writing to a pipe nobody reads
+// any more commonly get. A pipeline killed by Ctrl-C interrupts the command
+// line it is part of.
+func reportSignal(w io.Writer, err error) {
+	sig, ok := signalOf(err)
+	if !ok || sig == syscall.SIGPIPE {
+		return
+	}
+	if sig == syscall.SIGINT && jobControl {
+		interrupted.Store(true)
+		// after the ^C echoed by the terminal
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%s: terminated by signal %d\n", shellName, int(sig))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// traps holds the commands set with `trap`, by signal name without the SIG
+// prefix. Besides signals there are the pseudo-signals EXIT, run when the
+// shell exits, ERR, run after a command fails, DEBUG, run before every
+// command, and RETURN, run when a function returns. An empty command
+// ignores the signal.
+var traps = map[string]string{}
+
+// trapSignals are the signals that can be trapped, by name.
+var trapSignals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"WINCH": syscall.SIGWINCH,
+}
+
+var pseudoSignals = []string{"EXIT", "ERR", "DEBUG", "RETURN"}
+
+// trappedSignals gets the trapped signals, whose commands run between the
+// commands of the shell.
+var trappedSignals = make(chan os.Signal, 16)
+
+// runningTrap is set while a trap command runs, which does not trigger
+// other traps.
+var runningTrap bool
+
+// parseSignal returns the name of a signal given by name, with or without
+// the SIG prefix, or by number, 0 being EXIT.
+func parseSignal(spec string) (string, bool) {
+	name := strings.TrimPrefix(strings.ToUpper(spec), "SIG")
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n == 0 {
+			return "EXIT", true
+		}
+		for name, sig := range trapSignals {
+			if int(sig) == n {
+				return name, true
+			}
+		}
+		return "", false
+	}
+	if _, ok := trapSignals[name]; ok || slices.Contains(pseudoSignals, name) {
+		return name, true
+	}
+	return "", false
+}
+
+// setTrap sets the command for a signal and has the signal caught, or
+// ignored when command is empty.
+func setTrap(name string, command string) {
+	traps[name] = command
+	sig, ok := trapSignals[name]
+	switch {
+	case !ok:
+	case command == "":
+		signal.Ignore(sig)
+	default:
+		signal.Notify(trappedSignals, sig)
+	}
+}
+
+// resetTrap removes the command for a signal, which gets its default
+// behaviour back.
+func resetTrap(name string) {
+	delete(traps, name)
+	if sig, ok := trapSignals[name]; ok {
+		signal.Reset(sig)
+		if jobControl {
+			catchShellSignal(sig)
+		}
+	}
+}
+
+// runTrap runs the command set for a signal or pseudo-signal, if any,
+// leaving `$?` as it was. Traps only run in the shell itself, not in its
+// subshells and pipelines.
+func runTrap(name string) {
+	command, ok := traps[name]
+	if !ok || command == "" || runningTrap || subshellLevel > 0 {
+		return
+	}
+
+	runningTrap = true
+	status := lastExitStatus
+	executeLine(command, StandardStreams())
+	lastExitStatus = status
+	runningTrap = false
+}
+
+// runPendingTraps runs the traps of the signals received since the last
+// command.
+func runPendingTraps() {
+	if runningTrap || subshellLevel > 0 {
+		return
+	}
+	for {
+		select {
+		case sig := <-trappedSignals:
+			for name, trapSignal := range trapSignals {
+				if trapSignal == sig {
+					runTrap(name)
+				}
+			}
+		default:
+			return
+		}
+	}
+}
+
+// runExitTrap runs the EXIT trap once, with `$?` set to the status the
+// shell exits with.
+func runExitTrap(status int) {
+	runPendingTraps()
+	command, ok := traps["EXIT"]
+	if !ok {
+		return
+	}
+	delete(traps, "EXIT")
+	setExitStatus(status)
+	executeLine(command, StandardStreams())
+}
+
+// trapBuiltin sets the command run on the given signals with
+// `trap command SIG...`, ignores them when command is empty and resets them
+// with `trap - SIG...`. `trap` and `trap -p` print the traps in a form that
+// can be read back, and `trap -l` lists the signal names.
+func trapBuiltin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	switch {
+	case len(args) == 0 || args[0] == "-p":
+		names := slices.Sorted(maps.Keys(traps))
+		if len(args) > 1 {
+			names = nil
+			for _, spec := range args[1:] {
+				if name, ok := parseSignal(spec); ok {
+					names = append(names, name)
+				}
+			}
+		}
+		for _, name := range names {
+			if command, ok := traps[name]; ok {
+				fmt.Fprintf(stdout, "trap -- %s %s\n", quoteWord(command), name)
+			}
+		}
+		return nil
+	case args[0] == "-l":
+		names := slices.SortedFunc(maps.Keys(trapSignals), func(a, b string) int {
+			return cmp.Compare(trapSignals[a], trapSignals[b])
+		})
+		for _, name := range names {
+			fmt.Fprintf(stdout, "%2d) SIG%s\n", int(trapSignals[name]), name)
+		}
+		return nil
+	case args[0] == "--":
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+	command, specs := args[0], args[1:]
+	if _, ok := parseSignal(command); ok && len(specs) == 0 {
+		// `trap SIG` resets SIG
+		command, specs = "-", args
+	}
+	if len(specs) == 0 {
+		fmt.Fprintln(stderr, "trap: usage: trap [-lp] [[command] signal_spec ...]")
+		return ExitStatus(2)
+	}
+
+	var err error
+	for _, spec := range specs {
+		name, ok := parseSignal(spec)
+		if !ok {
+			fmt.Fprintf(stderr, "trap: %s: invalid signal specification\n", spec)
+			err = ExitStatus(1)
+			continue
+		}
+		if command == "-" {
+			resetTrap(name)
+		} else {
+			setTrap(name, command)
+		}
+	}
+	return err
+}
+
+// quoteWord quotes s with single quotes for the shell to read it back.
+func quoteWord(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
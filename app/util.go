@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"os"
 	"slices"
 )
@@ -30,6 +31,12 @@ func PerformTask[K any](items []K, callBack func(item K)) {
 	}
 }
 
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		closer.Close()
+	}
+}
+
 func AddItems(dest *[]string, src *[]string) {
 	for _, item := range *src {
 		if !slices.Contains(*dest, item) {
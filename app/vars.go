@@ -0,0 +1,149 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const shellName = "gosh"
+
+// scriptName is `$0`: the script being run, or the shell itself.
+var scriptName = shellName
+
+// lastExitStatus is the status of the most recent pipeline, exposed as `$?`.
+var lastExitStatus int
+
+// positionalParams are `$1`, `$2`, ... They are replaced by the arguments of
+// a function while it runs.
+var positionalParams []string
+
+// shellOptions are the options of the `set` builtin, by their long name.
+// noclobber (-C) keeps `>` from overwriting existing files.
+var shellOptions = map[string]bool{
+	"noclobber": false,
+}
+
+// shellOptionLetters maps the single letter forms of options to their names.
+var shellOptionLetters = map[byte]string{
+	'C': "noclobber",
+}
+
+// localScopes has a scope for every running function, holding the values
+// that the variables it declared `local` had before, to restore on return.
+var localScopes []map[string]savedVar
+
+type savedVar struct {
+	value string
+	set   bool
+}
+
+func setExitStatus(status int) int {
+	lastExitStatus = status
+	return status
+}
+
+// lookupVar returns the value of a shell variable or special parameter.
+// Variables live in the process environment, the same place .shellrc puts them.
+func lookupVar(name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(lastExitStatus), true
+	case "$":
+		return strconv.Itoa(os.Getpid()), true
+	case "!":
+		if lastBackgroundPid == 0 {
+			return "", false
+		}
+		return strconv.Itoa(lastBackgroundPid), true
+	case "0":
+		return scriptName, true
+	case "#":
+		return strconv.Itoa(len(positionalParams)), true
+	case "@":
+		return strings.Join(positionalParams, " "), true
+	case "*":
+		separator := ""
+		if ifs := fieldSeparators(); ifs != "" {
+			separator = ifs[:1]
+		}
+		return strings.Join(positionalParams, separator), true
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > len(positionalParams) {
+			return "", false
+		}
+		return positionalParams[n-1], true
+	}
+	return os.LookupEnv(name)
+}
+
+func setVar(name string, value string) error {
+	return os.Setenv(name, value)
+}
+
+// declareLocal makes name local to the running function.
+func declareLocal(name string) {
+	scope := localScopes[len(localScopes)-1]
+	if _, ok := scope[name]; ok {
+		return
+	}
+	value, set := os.LookupEnv(name)
+	scope[name] = savedVar{value: value, set: set}
+}
+
+// popScope restores the variables of the function that is returning.
+func popScope() {
+	scope := localScopes[len(localScopes)-1]
+	localScopes = localScopes[:len(localScopes)-1]
+	for name, saved := range scope {
+		if saved.set {
+			os.Setenv(name, saved.value)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func isNameStart(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isNameRune(r rune) bool {
+	return isNameStart(r) || (r >= '0' && r <= '9')
+}
+
+func isValidName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if i == 0 && !isNameStart(r) || !isNameRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// saveShellState records the working directory, the variables and the
+// functions and returns a function restoring them, which gives subshells
+// their own copy of the shell state.
+func saveShellState() func() {
+	cwd, _ := os.Getwd()
+	environment := os.Environ()
+	definedFunctions := maps.Clone(functions)
+	params := positionalParams
+
+	return func() {
+		functions = definedFunctions
+		positionalParams = params
+		os.Chdir(cwd)
+		os.Clearenv()
+		for _, variable := range environment {
+			name, value, _ := strings.Cut(variable, "=")
+			os.Setenv(name, value)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRuneWidth(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"abc", 3},
+		{"café", 4},
+		{"cafe\u0301", 4},
+		{"日本語", 6},
+		{"ｈｉ", 4},
+		{"한글", 4},
+		{"😀👍", 4},
+		{"\u2764\ufe0f", 1},
+		{"a\u200bb", 2},
+	}
+
+	for _, tt := range tests {
+		if got := runesWidth([]rune(tt.input)); got != tt.expected {
+			t.Errorf("runesWidth(%q) = %d, expected: %d", tt.input, got, tt.expected)
+		}
+	}
+}